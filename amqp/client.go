@@ -1,13 +1,16 @@
 package amqp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/streadway/amqp"
 
+	"github.com/PrairieLearn/autograd/config"
 	"github.com/PrairieLearn/autograd/grader"
 )
 
@@ -15,102 +18,211 @@ const (
 	consumerTag = "autograd-consumer"
 )
 
+// Grader grades a job. It is implemented by *grader.Grader.
+type Grader interface {
+	Grade(ctx context.Context, gid string, jobData []byte) (*grader.Result, error)
+}
+
+// channel is the part of *amqp.Channel used once the Client is set up.
+type channel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Cancel(consumer string, noWait bool) error
+}
+
 type Client struct {
-	conn         *amqp.Connection
-	channel      *amqp.Channel
-	gradingQueue amqp.Queue
-	startedQueue amqp.Queue
-	resultQueue  amqp.Queue
-	grader       *grader.Grader
-	done         chan error
+	conn            *amqp.Connection
+	channel         channel
+	gradingQueue    amqp.Queue
+	startedQueue    amqp.Queue
+	resultQueue     amqp.Queue
+	deadLetterQueue *amqp.Queue // nil if no dead letter queue is configured
+	grader          Grader
+	workers         int
+	maxRetries      int
+	channelMu       sync.Mutex
+	confirms        *confirmTracker
+	confirmTimeout  time.Duration
+	publishRetries  int
+	ctx             context.Context // canceled by Abort
+	abort           context.CancelFunc
+	closed          chan *amqp.Error // receives when the connection is lost
+	done            chan error
 }
 
-func NewClient(amqpURI, gradingQueueName, startedQueueName, resultQueueName string, grader *grader.Grader) (
-	*Client, error) {
+func NewClient(cfg config.AMQPConfig, grader Grader) (*Client, error) {
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	maxRetries := defaultMaxRetries
+	if cfg.MaxRetries != nil {
+		maxRetries = *cfg.MaxRetries
+	}
+	publishRetries := defaultPublishRetries
+	if cfg.PublishRetries != nil {
+		publishRetries = *cfg.PublishRetries
+	}
+
 	c := &Client{
-		conn:    nil,
-		channel: nil,
-		grader:  grader,
-		done:    make(chan error),
+		conn:           nil,
+		channel:        nil,
+		grader:         grader,
+		workers:        workers,
+		maxRetries:     maxRetries,
+		confirms:       newConfirmTracker(),
+		confirmTimeout: defaultConfirmTimeout,
+		publishRetries: publishRetries,
+		done:           make(chan error, 1),
+	}
+	c.ctx, c.abort = context.WithCancel(context.Background())
+	if cfg.ConfirmTimeout > 0 {
+		c.confirmTimeout = time.Duration(cfg.ConfirmTimeout) * time.Second
 	}
 
 	var err error
 
-	log.Debugf("Dialing %q", amqpURI)
-	c.conn, err = amqp.Dial(amqpURI)
+	log.Debugf("Dialing %q", cfg.URL)
+	c.conn, err = amqp.Dial(cfg.URL)
 	if err != nil {
 		return nil, fmt.Errorf("Dial: %s", err)
 	}
+	c.closed = c.conn.NotifyClose(make(chan *amqp.Error, 1))
 
 	log.Debugf("Got Connection, getting Channel")
-	c.channel, err = c.conn.Channel()
+	ch, err := c.conn.Channel()
 	if err != nil {
 		return nil, fmt.Errorf("Channel: %s", err)
 	}
-	if err := c.channel.Qos(1, 0, false); err != nil {
+	c.channel = ch
+	if err := ch.Qos(c.workers, 0, false); err != nil {
 		return nil, fmt.Errorf("Channel Qos: %s", err)
 	}
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("Channel Confirm: %s", err)
+	}
+	go c.confirms.run(ch.NotifyPublish(make(chan amqp.Confirmation, confirmBufferSize)))
 
-	log.Debugf("Got Channel, declaring Queues %q, %q, %q", gradingQueueName, startedQueueName, resultQueueName)
-	c.gradingQueue, err = c.channel.QueueDeclare(gradingQueueName, true, false, false, false, nil)
+	log.Debugf("Got Channel, declaring Queues %q, %q, %q", cfg.GradingQueue, cfg.StartedQueue, cfg.ResultQueue)
+	c.gradingQueue, err = ch.QueueDeclare(cfg.GradingQueue, true, false, false, false, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Queue Declare: %s", err)
 	}
 
-	c.startedQueue, err = c.channel.QueueDeclare(startedQueueName, true, false, false, false, nil)
+	c.startedQueue, err = ch.QueueDeclare(cfg.StartedQueue, true, false, false, false, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Queue Declare: %s", err)
 	}
 
-	c.resultQueue, err = c.channel.QueueDeclare(resultQueueName, true, false, false, false, nil)
+	c.resultQueue, err = ch.QueueDeclare(cfg.ResultQueue, true, false, false, false, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Queue Declare: %s", err)
 	}
 
+	if cfg.DeadLetterQueue != "" {
+		log.Debugf("Declaring dead letter Queue %q", cfg.DeadLetterQueue)
+		q, err := ch.QueueDeclare(cfg.DeadLetterQueue, true, false, false, false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Queue Declare: %s", err)
+		}
+		c.deadLetterQueue = &q
+	}
+
 	log.Debugf("Declared Queue (%q %d messages, %d consumers), starting Consume (consumer tag %q)",
 		c.gradingQueue.Name, c.gradingQueue.Messages, c.gradingQueue.Consumers, consumerTag)
-	deliveries, err := c.channel.Consume(c.gradingQueue.Name, consumerTag, false, false, false, false, nil)
+	deliveries, err := ch.Consume(c.gradingQueue.Name, consumerTag, false, false, false, false, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Queue Consume: %s", err)
 	}
 
 	go c.handle(deliveries, c.done)
 
+	log.Debugf("Started %d grading workers", c.workers)
+
 	return c, nil
 }
 
+// Shutdown stops consuming, waits for the jobs being graded to finish and
+// closes the connection.
 func (c *Client) Shutdown() error {
-	// will close() the deliveries channel
-	if err := c.channel.Cancel(consumerTag, true); err != nil {
-		return fmt.Errorf("Client cancel failed: %s", err)
-	}
+	err := c.stopWorkers()
 
-	if err := c.conn.Close(); err != nil {
+	if err := c.conn.Close(); err != nil && err != amqp.ErrClosed {
 		return fmt.Errorf("AMQP connection close error: %s", err)
 	}
 
-	defer log.Debugf("AMQP shutdown OK")
+	log.Debugf("AMQP shutdown OK")
+	return err
+}
+
+// stopWorkers stops consuming and waits for the workers to exit. If the
+// connection has been lost, the jobs being graded can no longer be acked and
+// the broker redelivers them, so they are aborted instead of finished.
+func (c *Client) stopWorkers() error {
+	select {
+	case <-c.closed:
+		// The channel closed with the connection, which closed the
+		// deliveries channel.
+		log.Info("AMQP connection lost, aborting jobs being graded")
+		c.Abort()
+	default:
+		// will close() the deliveries channel
+		if err := c.channel.Cancel(consumerTag, true); err != nil {
+			log.Warnf("Client cancel failed, aborting jobs being graded: %s", err)
+			c.Abort()
+		}
+	}
 
-	// wait for handle() to exit
+	// wait for handle() to exit, so the results of the last jobs can still
+	// be published
 	return <-c.done
 }
 
+// Abort cancels the jobs being graded, stopping their commands and
+// requeueing them with an incremented x-autograd-redeliveries header so they
+// are graded again by another worker.
+func (c *Client) Abort() {
+	c.abort()
+}
+
 func (c *Client) NotifyClose() chan *amqp.Error {
 	return c.conn.NotifyClose(make(chan *amqp.Error))
 }
 
 func (c *Client) handle(deliveries <-chan amqp.Delivery, done chan error) {
+	var wg sync.WaitGroup
+	for i := 0; i < c.workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			c.work(worker, deliveries)
+		}(i)
+	}
+	wg.Wait()
+
+	log.Debugf("handle: deliveries channel closed")
+	done <- nil
+}
+
+func (c *Client) work(worker int, deliveries <-chan amqp.Delivery) {
 	for d := range deliveries {
 		log.WithFields(log.Fields{
 			"queue":        c.gradingQueue.Name,
 			"size":         len(d.Body),
 			"delivery_tag": d.DeliveryTag,
+			"worker":       worker,
+			"redeliveries": getCount(d.Headers, redeliveriesHeader),
 		}).Info("Received grading job")
 		log.Debug(string(d.Body))
+		jobsReceived.Inc()
 
-		gid, err := parseGID(d.Body)
+		if c.releaseIfAborted(d) {
+			continue
+		}
+
+		gid, err := ParseGID(d.Body)
 		if err != nil {
 			log.Warnf("Error parsing gid from job data: %v", err)
+			c.deadLetter(d, "", fmt.Errorf("Error parsing gid from job data: %v", err))
 			continue
 		}
 
@@ -119,24 +231,60 @@ func (c *Client) handle(deliveries <-chan amqp.Delivery, done chan error) {
 			Time: time.Now().Format(time.RFC3339),
 		}); err != nil {
 			log.Warnf("Error publishing started message: %v", err)
+			c.retry(d, gid, fmt.Errorf("Error publishing started message: %v", err))
+			continue
+		}
+
+		if c.releaseIfAborted(d) {
 			continue
 		}
 
-		result, err := c.grader.Grade(gid, d.Body)
+		result, err := c.grader.Grade(c.ctx, gid, d.Body)
+		if c.ctx.Err() != nil {
+			c.requeue(d, gid)
+			continue
+		}
 		if err != nil {
 			log.Warnf("Error initializing grader: %v", err)
-			continue
+			jobsFailed.Inc("internal_error")
+			result = grader.NewErrorResult(gid, grader.StatusInternalError,
+				"An internal error occurred while grading your submission")
 		}
 
 		if err := c.publishJSON(c.resultQueue, result); err != nil {
 			log.Warnf("Error publishing grading result: %v", err)
+			c.retry(d, gid, fmt.Errorf("Error publishing grading result: %v", err))
 			continue
 		}
 
-		d.Ack(false)
+		c.ack(d)
+		jobsAcked.Inc()
+	}
+}
+
+// releaseIfAborted requeues a delivery as it was received if the client has
+// been aborted, which happens to the jobs prefetched by a worker that was
+// still grading. They have not been interrupted, so unlike requeue it leaves
+// the redeliveries header alone.
+func (c *Client) releaseIfAborted(d amqp.Delivery) bool {
+	if c.ctx.Err() == nil {
+		return false
+	}
+	log.WithField("delivery_tag", d.DeliveryTag).Info("Client aborted, releasing grading job")
+	jobsRequeued.Inc("released")
+	c.nack(d, true)
+	return true
+}
+
+// ack acknowledges a delivery. The channel is shared between workers, so
+// acks are serialized with publishes.
+func (c *Client) ack(d amqp.Delivery) {
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+
+	if err := d.Ack(false); err != nil {
+		log.Warnf("Error acking delivery %d: %v", d.DeliveryTag, err)
 	}
-	log.Debugf("handle: deliveries channel closed")
-	done <- nil
 }
 
 func (c *Client) publishJSON(queue amqp.Queue, body interface{}) error {
@@ -145,21 +293,56 @@ func (c *Client) publishJSON(queue amqp.Queue, body interface{}) error {
 		return err
 	}
 
-	msg := amqp.Publishing{
+	return c.publish(queue, amqp.Publishing{
 		DeliveryMode: amqp.Persistent,
 		Timestamp:    time.Now(),
 		ContentType:  "application/json",
 		Body:         jsonBody,
+	})
+}
+
+// publish publishes a message and waits for the broker to confirm it,
+// retrying up to publishRetries times if the confirm is negative or does not
+// arrive within confirmTimeout. A publish which times out may still reach the
+// queue, so a retried message can be delivered more than once.
+func (c *Client) publish(queue amqp.Queue, msg amqp.Publishing) error {
+	var err error
+	for attempt := 0; attempt <= c.publishRetries; attempt++ {
+		if attempt > 0 {
+			log.WithFields(log.Fields{
+				"queue":   queue.Name,
+				"attempt": attempt + 1,
+			}).Warnf("Retrying publish: %v", err)
+		}
+
+		var confirmed <-chan bool
+		confirmed, err = c.publishOnce(queue, msg)
+		if err != nil {
+			continue
+		}
+		if err = c.confirms.wait(confirmed, c.confirmTimeout); err == nil {
+			return nil
+		}
 	}
-	err = c.channel.Publish("", queue.Name, false, false, msg)
+	return err
+}
+
+func (c *Client) publishOnce(queue amqp.Queue, msg amqp.Publishing) (<-chan bool, error) {
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+
+	confirmed := c.confirms.expect()
+	err := c.channel.Publish("", queue.Name, false, false, msg)
 	if err != nil {
-		return err
+		c.confirms.cancel()
+		return nil, err
 	}
 
-	return nil
+	return confirmed, nil
 }
 
-func parseGID(jobData []byte) (string, error) {
+// ParseGID returns the gid of a grading job.
+func ParseGID(jobData []byte) (string, error) {
 	var job struct {
 		GID string `json:"gid"`
 	}
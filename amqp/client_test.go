@@ -0,0 +1,297 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/PrairieLearn/autograd/grader"
+)
+
+// fakeChannel records publishes and confirms each one straight away, nacking
+// publishes to the queues in nackQueues. Once closed, it fails like a channel
+// whose connection was lost.
+type fakeChannel struct {
+	mu         sync.Mutex
+	published  []fakePublishing
+	confirms   chan amqp.Confirmation
+	nackQueues map[string]bool
+	closed     bool
+	canceled   bool
+}
+
+type fakePublishing struct {
+	queue string
+	msg   amqp.Publishing
+}
+
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.published = append(ch.published, fakePublishing{queue: key, msg: msg})
+	ch.confirms <- amqp.Confirmation{DeliveryTag: uint64(len(ch.published)), Ack: !ch.nackQueues[key]}
+	return nil
+}
+
+func (ch *fakeChannel) Cancel(consumer string, noWait bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.canceled = true
+	return nil
+}
+
+func (ch *fakeChannel) close() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.closed = true
+}
+
+// publishedTo returns the messages published to queue.
+func (ch *fakeChannel) publishedTo(queue string) []amqp.Publishing {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	var msgs []amqp.Publishing
+	for _, p := range ch.published {
+		if p.queue == queue {
+			msgs = append(msgs, p.msg)
+		}
+	}
+	return msgs
+}
+
+// fakeAcknowledger records how each delivery was settled: "ack", "nack" or
+// "requeue".
+type fakeAcknowledger struct {
+	mu      sync.Mutex
+	settled map[uint64]string
+}
+
+func (a *fakeAcknowledger) settle(tag uint64, how string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if prev, ok := a.settled[tag]; ok {
+		return fmt.Errorf("delivery %d settled twice (%s, then %s)", tag, prev, how)
+	}
+	a.settled[tag] = how
+	return nil
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.settle(tag, "ack")
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	if requeue {
+		return a.settle(tag, "requeue")
+	}
+	return a.settle(tag, "nack")
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+type graderFunc func(ctx context.Context, gid string, jobData []byte) (*grader.Result, error)
+
+func (f graderFunc) Grade(ctx context.Context, gid string, jobData []byte) (*grader.Result, error) {
+	return f(ctx, gid, jobData)
+}
+
+func succeed(ctx context.Context, gid string, jobData []byte) (*grader.Result, error) {
+	return &grader.Result{GID: gid, Grading: grader.Grading{Status: grader.StatusSucceeded}}, nil
+}
+
+func newTestClient(g Grader, workers int) (*Client, *fakeChannel) {
+	ch := &fakeChannel{
+		confirms:   make(chan amqp.Confirmation, 64),
+		nackQueues: make(map[string]bool),
+	}
+	c := &Client{
+		channel:        ch,
+		gradingQueue:   amqp.Queue{Name: "grade"},
+		startedQueue:   amqp.Queue{Name: "started"},
+		resultQueue:    amqp.Queue{Name: "result"},
+		grader:         g,
+		workers:        workers,
+		confirms:       newConfirmTracker(),
+		confirmTimeout: time.Second,
+		closed:         make(chan *amqp.Error, 1),
+		done:           make(chan error, 1),
+	}
+	c.ctx, c.abort = context.WithCancel(context.Background())
+	go c.confirms.run(ch.confirms)
+	return c, ch
+}
+
+// handleJobs runs the client's workers over a delivery for each job body and
+// returns how each was settled, by delivery tag.
+func handleJobs(t *testing.T, c *Client, bodies ...string) map[uint64]string {
+	ack := &fakeAcknowledger{settled: make(map[uint64]string)}
+	deliveries := make(chan amqp.Delivery, len(bodies))
+	for i, body := range bodies {
+		deliveries <- amqp.Delivery{
+			Acknowledger: ack,
+			DeliveryTag:  uint64(i + 1),
+			Body:         []byte(body),
+		}
+	}
+	close(deliveries)
+
+	go c.handle(deliveries, c.done)
+	select {
+	case <-c.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("workers did not finish")
+	}
+	return ack.settled
+}
+
+func TestWorkersGradeConcurrently(t *testing.T) {
+	const workers = 3
+
+	var running int32
+	allRunning := make(chan struct{})
+	c, ch := newTestClient(graderFunc(func(ctx context.Context, gid string, jobData []byte) (*grader.Result, error) {
+		if atomic.AddInt32(&running, 1) == workers {
+			close(allRunning)
+		}
+		select {
+		case <-allRunning:
+		case <-time.After(5 * time.Second):
+			t.Errorf("job %s: only %d jobs graded concurrently", gid, atomic.LoadInt32(&running))
+		}
+		return succeed(ctx, gid, jobData)
+	}), workers)
+
+	settled := handleJobs(t, c, `{"gid": "g1"}`, `{"gid": "g2"}`, `{"gid": "g3"}`)
+
+	for tag := uint64(1); tag <= workers; tag++ {
+		if settled[tag] != "ack" {
+			t.Errorf("delivery %d: got %q, want ack", tag, settled[tag])
+		}
+	}
+	if n := len(ch.publishedTo("started")); n != workers {
+		t.Errorf("got %d started messages, want %d", n, workers)
+	}
+	if n := len(ch.publishedTo("result")); n != workers {
+		t.Errorf("got %d results, want %d", n, workers)
+	}
+}
+
+func TestWorkersAckEachJob(t *testing.T) {
+	tests := []struct {
+		workers int
+		jobs    int
+	}{
+		{workers: 1, jobs: 5},
+		{workers: 4, jobs: 2},
+		{workers: 4, jobs: 20},
+	}
+
+	for _, tt := range tests {
+		c, ch := newTestClient(graderFunc(succeed), tt.workers)
+
+		var bodies []string
+		for i := 0; i < tt.jobs; i++ {
+			bodies = append(bodies, fmt.Sprintf(`{"gid": "g%d"}`, i))
+		}
+		settled := handleJobs(t, c, bodies...)
+
+		acked := 0
+		for _, how := range settled {
+			if how == "ack" {
+				acked++
+			}
+		}
+		if acked != tt.jobs {
+			t.Errorf("%d workers: %d of %d jobs acked", tt.workers, acked, tt.jobs)
+		}
+		if n := len(ch.publishedTo("result")); n != tt.jobs {
+			t.Errorf("%d workers: got %d results, want %d", tt.workers, n, tt.jobs)
+		}
+	}
+}
+
+func TestAbortReleasesPrefetchedJobs(t *testing.T) {
+	graded := 0
+	c, ch := newTestClient(graderFunc(func(ctx context.Context, gid string, jobData []byte) (*grader.Result, error) {
+		graded++
+		return succeed(ctx, gid, jobData)
+	}), 1)
+	c.Abort()
+
+	settled := handleJobs(t, c, `{"gid": "g1"}`, `{"gid": "g2"}`)
+
+	for tag := uint64(1); tag <= 2; tag++ {
+		if settled[tag] != "requeue" {
+			t.Errorf("delivery %d: got %q, want requeue", tag, settled[tag])
+		}
+	}
+	if graded != 0 {
+		t.Errorf("graded %d jobs after abort", graded)
+	}
+	if n := len(ch.publishedTo("started")); n != 0 {
+		t.Errorf("got %d started messages after abort", n)
+	}
+	if n := len(ch.publishedTo("grade")); n != 0 {
+		t.Errorf("republished %d jobs to the grading queue, want them nacked", n)
+	}
+}
+
+func TestStopWorkersAfterConnectionLost(t *testing.T) {
+	grading := make(chan struct{})
+	c, ch := newTestClient(graderFunc(func(ctx context.Context, gid string, jobData []byte) (*grader.Result, error) {
+		close(grading)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}), 1)
+
+	deliveries := make(chan amqp.Delivery, 1)
+	deliveries <- amqp.Delivery{
+		Acknowledger: &fakeAcknowledger{settled: make(map[uint64]string)},
+		DeliveryTag:  1,
+		Body:         []byte(`{"gid": "g1"}`),
+	}
+	go c.handle(deliveries, c.done)
+	<-grading
+
+	// Losing the connection closes its channel and the deliveries channel.
+	ch.close()
+	close(deliveries)
+	c.closed <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "connection lost"}
+
+	stopped := make(chan error)
+	go func() { stopped <- c.stopWorkers() }()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("workers did not stop after the connection was lost")
+	}
+	if ch.canceled {
+		t.Error("canceled the consumer on a closed channel")
+	}
+	if c.ctx.Err() == nil {
+		t.Error("did not abort the job being graded")
+	}
+	select {
+	case <-c.done:
+		t.Error("stopped before the workers exited")
+	default:
+	}
+}
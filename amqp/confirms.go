@@ -0,0 +1,94 @@
+package amqp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultConfirmTimeout = 30 * time.Second
+	defaultPublishRetries = 3
+	confirmBufferSize     = 16
+)
+
+// confirmTracker matches publisher confirms from the broker to the
+// publishes waiting on them. Delivery tags are assigned by the broker in
+// publish order starting from 1, so expect and cancel must be called while
+// holding the lock that serializes publishes.
+type confirmTracker struct {
+	mu        sync.Mutex
+	published uint64
+	pending   map[uint64]chan bool
+	closed    bool
+}
+
+func newConfirmTracker() *confirmTracker {
+	return &confirmTracker{
+		pending: make(map[uint64]chan bool),
+	}
+}
+
+// expect registers the next publish and returns a channel which receives
+// whether the broker acked it.
+func (t *confirmTracker) expect() <-chan bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	confirmed := make(chan bool, 1)
+	if t.closed {
+		confirmed <- false
+		return confirmed
+	}
+	t.published++
+	t.pending[t.published] = confirmed
+	return confirmed
+}
+
+// cancel unregisters the last publish after it failed to send.
+func (t *confirmTracker) cancel() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, t.published)
+	t.published--
+}
+
+func (t *confirmTracker) wait(confirmed <-chan bool, timeout time.Duration) error {
+	select {
+	case ack := <-confirmed:
+		if !ack {
+			return errors.New("Publish was not confirmed by the broker")
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("Timed out after %s waiting for publish confirm", timeout.String())
+	}
+}
+
+// run dispatches confirms until the channel is closed, then fails every
+// publish still waiting.
+func (t *confirmTracker) run(confirms <-chan amqp.Confirmation) {
+	for conf := range confirms {
+		t.mu.Lock()
+		confirmed, ok := t.pending[conf.DeliveryTag]
+		delete(t.pending, conf.DeliveryTag)
+		t.mu.Unlock()
+
+		if ok {
+			confirmed <- conf.Ack
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	for tag, confirmed := range t.pending {
+		confirmed <- false
+		delete(t.pending, tag)
+	}
+}
@@ -0,0 +1,100 @@
+package amqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConfirmTracker(t *testing.T) {
+	tests := []struct {
+		name      string
+		publishes int
+		cancel    bool // cancel the last publish
+		confirms  []amqp.Confirmation
+		want      []bool
+	}{
+		{
+			name:      "in order",
+			publishes: 2,
+			confirms:  []amqp.Confirmation{{DeliveryTag: 1, Ack: true}, {DeliveryTag: 2, Ack: true}},
+			want:      []bool{true, true},
+		},
+		{
+			name:      "out of order",
+			publishes: 3,
+			confirms: []amqp.Confirmation{
+				{DeliveryTag: 3, Ack: true}, {DeliveryTag: 1, Ack: false}, {DeliveryTag: 2, Ack: true},
+			},
+			want: []bool{false, true, true},
+		},
+		{
+			name:      "closed before confirm",
+			publishes: 2,
+			confirms:  []amqp.Confirmation{{DeliveryTag: 1, Ack: true}},
+			want:      []bool{true, false},
+		},
+		{
+			name:      "unknown tag",
+			publishes: 1,
+			confirms:  []amqp.Confirmation{{DeliveryTag: 7, Ack: true}, {DeliveryTag: 1, Ack: true}},
+			want:      []bool{true},
+		},
+		{
+			name:      "cancelled publish reuses tag",
+			publishes: 2,
+			cancel:    true,
+			confirms:  []amqp.Confirmation{{DeliveryTag: 1, Ack: true}, {DeliveryTag: 2, Ack: true}},
+			want:      []bool{true, true},
+		},
+	}
+
+	for _, tt := range tests {
+		tracker := newConfirmTracker()
+		var confirmed []<-chan bool
+		for i := 0; i < tt.publishes; i++ {
+			confirmed = append(confirmed, tracker.expect())
+		}
+		if tt.cancel {
+			tracker.cancel()
+			confirmed[len(confirmed)-1] = tracker.expect()
+		}
+
+		confirms := make(chan amqp.Confirmation, len(tt.confirms))
+		for _, conf := range tt.confirms {
+			confirms <- conf
+		}
+		close(confirms)
+		tracker.run(confirms)
+
+		for i, want := range tt.want {
+			select {
+			case got := <-confirmed[i]:
+				if got != want {
+					t.Errorf("%s: publish %d: got ack %v, want %v", tt.name, i+1, got, want)
+				}
+			default:
+				t.Errorf("%s: publish %d was never confirmed", tt.name, i+1)
+			}
+		}
+	}
+}
+
+func TestConfirmTrackerExpectAfterClose(t *testing.T) {
+	tracker := newConfirmTracker()
+	confirms := make(chan amqp.Confirmation)
+	close(confirms)
+	tracker.run(confirms)
+
+	if err := tracker.wait(tracker.expect(), time.Second); err == nil {
+		t.Error("publish after close was confirmed")
+	}
+}
+
+func TestConfirmTrackerWaitTimeout(t *testing.T) {
+	tracker := newConfirmTracker()
+	if err := tracker.wait(tracker.expect(), 10*time.Millisecond); err == nil {
+		t.Error("wait without a confirm did not time out")
+	}
+}
@@ -0,0 +1,149 @@
+package amqp
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/streadway/amqp"
+
+	"github.com/PrairieLearn/autograd/grader"
+)
+
+// defaultMaxRetries is how many times a job is retried when max_retries is
+// not set.
+const defaultMaxRetries = 3
+
+const (
+	retriesHeader      = "x-autograd-retries"
+	redeliveriesHeader = "x-autograd-redeliveries"
+	errorHeader        = "x-autograd-error"
+)
+
+// retry requeues a delivery which could not be processed. RabbitMQ does not
+// let a nack change the message headers, so the retry count is tracked by
+// republishing a copy of the job with an incremented retries header and
+// acking the original. Once the job has been retried MaxRetries times it is
+// dead-lettered instead.
+func (c *Client) retry(d amqp.Delivery, gid string, cause error) {
+	retries := getCount(d.Headers, retriesHeader)
+	if retries >= c.maxRetries {
+		c.deadLetter(d, gid, cause)
+		return
+	}
+
+	fields := log.Fields{
+		"gid":     gid,
+		"retries": retries + 1,
+	}
+
+	msg := copyDelivery(d)
+	msg.Headers[retriesHeader] = int32(retries + 1)
+	msg.Headers[errorHeader] = cause.Error()
+	if err := c.publish(c.gradingQueue, msg); err != nil {
+		log.WithFields(fields).Warnf("Error republishing job, requeueing: %v", err)
+		c.nack(d, true)
+		return
+	}
+
+	log.WithFields(fields).Info("Requeued grading job")
+	jobsRequeued.Inc("retried")
+	c.ack(d)
+}
+
+// requeue puts a job whose grading was aborted back on the grading queue,
+// counting the interruption in the redeliveries header so the worker which
+// picks it up knows it was interrupted. Aborted jobs do not count towards
+// MaxRetries.
+func (c *Client) requeue(d amqp.Delivery, gid string) {
+	redeliveries := getCount(d.Headers, redeliveriesHeader) + 1
+	fields := log.Fields{
+		"gid":          gid,
+		"redeliveries": redeliveries,
+	}
+
+	msg := copyDelivery(d)
+	msg.Headers[redeliveriesHeader] = int32(redeliveries)
+	if err := c.publish(c.gradingQueue, msg); err != nil {
+		log.WithFields(fields).Warnf("Error republishing aborted job, requeueing: %v", err)
+		c.nack(d, true)
+		return
+	}
+
+	log.WithFields(fields).Info("Requeued aborted grading job")
+	jobsRequeued.Inc("aborted")
+	c.ack(d)
+}
+
+// deadLetter gives up on a delivery, publishing an error result for it if the
+// gid is known and moving it to the dead letter queue. Without a dead letter
+// queue the job is rejected and logged instead; requeueing it would only have
+// it redelivered and fail again straight away.
+func (c *Client) deadLetter(d amqp.Delivery, gid string, cause error) {
+	fields := log.Fields{
+		"gid":     gid,
+		"retries": getCount(d.Headers, retriesHeader),
+	}
+
+	if gid != "" {
+		result := grader.NewErrorResult(gid, grader.StatusInternalError,
+			"An internal error occurred while grading your submission")
+		if err := c.publishJSON(c.resultQueue, result); err != nil {
+			log.WithFields(fields).Warnf("Error publishing error result: %v", err)
+		}
+	}
+
+	if c.deadLetterQueue == nil {
+		log.WithFields(fields).Errorf("No dead letter queue configured, dropping grading job %q: %v", d.Body, cause)
+		jobsFailed.Inc("rejected")
+		c.nack(d, false)
+		return
+	}
+
+	msg := copyDelivery(d)
+	msg.Headers[errorHeader] = cause.Error()
+	if err := c.publish(*c.deadLetterQueue, msg); err != nil {
+		log.WithFields(fields).Warnf("Error publishing to dead letter queue, requeueing: %v", err)
+		c.nack(d, true)
+		return
+	}
+
+	log.WithFields(fields).Warnf("Moved grading job to dead letter queue %q: %v", c.deadLetterQueue.Name, cause)
+	jobsFailed.Inc("dead_lettered")
+	c.ack(d)
+}
+
+func (c *Client) nack(d amqp.Delivery, requeue bool) {
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+
+	if err := d.Nack(false, requeue); err != nil {
+		log.Warnf("Error nacking delivery %d: %v", d.DeliveryTag, err)
+	}
+}
+
+func copyDelivery(d amqp.Delivery) amqp.Publishing {
+	headers := make(amqp.Table)
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+
+	return amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		ContentType:  d.ContentType,
+		Body:         d.Body,
+	}
+}
+
+func getCount(headers amqp.Table, name string) int {
+	switch v := headers[name].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package amqp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestGetCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    int
+	}{
+		{name: "missing", headers: nil, want: 0},
+		{name: "int32", headers: amqp.Table{retriesHeader: int32(2)}, want: 2},
+		{name: "int64", headers: amqp.Table{retriesHeader: int64(3)}, want: 3},
+		{name: "int", headers: amqp.Table{retriesHeader: 4}, want: 4},
+		{name: "wrong type", headers: amqp.Table{retriesHeader: "5"}, want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := getCount(tt.headers, retriesHeader); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      int
+		deadLetter   bool
+		settled      string
+		republished  bool
+		deadLettered bool
+		errorResult  bool
+	}{
+		{name: "first failure", retries: 0, deadLetter: true, settled: "ack", republished: true},
+		{name: "last retry", retries: 2, deadLetter: true, settled: "ack", republished: true},
+		{name: "out of retries", retries: 3, deadLetter: true, settled: "ack", deadLettered: true, errorResult: true},
+		{name: "out of retries without dead letter queue", retries: 3, settled: "nack", errorResult: true},
+	}
+
+	for _, tt := range tests {
+		c, ch := newTestClient(graderFunc(succeed), 1)
+		c.maxRetries = defaultMaxRetries
+		if tt.deadLetter {
+			c.deadLetterQueue = &amqp.Queue{Name: "dead"}
+		}
+		ack := &fakeAcknowledger{settled: make(map[uint64]string)}
+		d := amqp.Delivery{
+			Acknowledger: ack,
+			DeliveryTag:  1,
+			Headers:      amqp.Table{retriesHeader: int32(tt.retries)},
+			Body:         []byte(`{"gid": "g1"}`),
+		}
+
+		c.retry(d, "g1", errors.New("publish failed"))
+
+		if ack.settled[1] != tt.settled {
+			t.Errorf("%s: got %q, want %q", tt.name, ack.settled[1], tt.settled)
+		}
+		republished := ch.publishedTo("grade")
+		if (len(republished) == 1) != tt.republished {
+			t.Errorf("%s: got %d republished jobs", tt.name, len(republished))
+		} else if tt.republished {
+			if got := getCount(republished[0].Headers, retriesHeader); got != tt.retries+1 {
+				t.Errorf("%s: got retries header %d, want %d", tt.name, got, tt.retries+1)
+			}
+		}
+		deadLettered := ch.publishedTo("dead")
+		if (len(deadLettered) == 1) != tt.deadLettered {
+			t.Errorf("%s: got %d dead-lettered jobs", tt.name, len(deadLettered))
+		} else if tt.deadLettered && deadLettered[0].Headers[errorHeader] != "publish failed" {
+			t.Errorf("%s: got error header %v", tt.name, deadLettered[0].Headers[errorHeader])
+		}
+		if n := len(ch.publishedTo("result")); (n == 1) != tt.errorResult {
+			t.Errorf("%s: got %d error results", tt.name, n)
+		}
+	}
+}
+
+func TestStartedNackRetriesJob(t *testing.T) {
+	c, ch := newTestClient(graderFunc(succeed), 1)
+	c.maxRetries = defaultMaxRetries
+	ch.nackQueues["started"] = true
+
+	settled := handleJobs(t, c, `{"gid": "g1"}`)
+
+	if settled[1] != "ack" {
+		t.Errorf("got %q, want ack", settled[1])
+	}
+	republished := ch.publishedTo("grade")
+	if len(republished) != 1 {
+		t.Fatalf("got %d republished jobs, want 1", len(republished))
+	}
+	if got := getCount(republished[0].Headers, retriesHeader); got != 1 {
+		t.Errorf("got retries header %d, want 1", got)
+	}
+	if n := len(ch.publishedTo("result")); n != 0 {
+		t.Errorf("got %d results, want 0", n)
+	}
+}
+
+func TestUnparseableJobRejectedWithoutDeadLetterQueue(t *testing.T) {
+	c, ch := newTestClient(graderFunc(succeed), 1)
+
+	settled := handleJobs(t, c, `not json`)
+
+	if settled[1] != "nack" {
+		t.Errorf("got %q, want nack", settled[1])
+	}
+	if n := len(ch.publishedTo("grade")) + len(ch.publishedTo("result")); n != 0 {
+		t.Errorf("got %d published messages, want 0", n)
+	}
+}
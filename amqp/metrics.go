@@ -0,0 +1,16 @@
+package amqp
+
+import (
+	"github.com/PrairieLearn/autograd/metrics"
+)
+
+var (
+	jobsReceived = metrics.NewCounter("autograd_jobs_received_total",
+		"Grading jobs received from the grading queue.")
+	jobsAcked = metrics.NewCounter("autograd_jobs_acked_total",
+		"Grading jobs whose result was published and which were acked.")
+	jobsFailed = metrics.NewCounter("autograd_jobs_failed_total",
+		"Grading jobs which could not be processed, by what was done with them.", "reason")
+	jobsRequeued = metrics.NewCounter("autograd_jobs_requeued_total",
+		"Grading jobs put back on the grading queue to be graded again, by why.", "reason")
+)
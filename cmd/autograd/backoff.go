@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultReconnectInterval    = 1 * time.Second
+	defaultMaxReconnectInterval = 60 * time.Second
+)
+
+// backoff computes the wait between reconnect attempts. The interval doubles
+// after each failed attempt up to max, and each wait is picked at random
+// from the upper half of the interval so that autograd processes which lost
+// their connection together do not retry in lockstep.
+type backoff struct {
+	initial     time.Duration
+	max         time.Duration
+	maxAttempts int // 0 means never give up
+	attempts    int
+	rand        *rand.Rand
+}
+
+func newBackoff(initial, max time.Duration, maxAttempts int) *backoff {
+	if initial <= 0 {
+		initial = defaultReconnectInterval
+	}
+	if max <= 0 {
+		max = defaultMaxReconnectInterval
+	}
+	if max < initial {
+		max = initial
+	}
+	return &backoff{
+		initial:     initial,
+		max:         max,
+		maxAttempts: maxAttempts,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next records a failed attempt and returns how long to wait before the next
+// one, or false if maxAttempts attempts have failed.
+func (b *backoff) next() (time.Duration, bool) {
+	b.attempts++
+	if b.maxAttempts > 0 && b.attempts >= b.maxAttempts {
+		return 0, false
+	}
+
+	interval := b.initial
+	for i := 1; i < b.attempts && interval < b.max; i++ {
+		interval *= 2
+	}
+	if interval > b.max {
+		interval = b.max
+	}
+
+	half := interval / 2
+	return half + time.Duration(b.rand.Int63n(int64(interval-half)+1)), true
+}
+
+// reset is called after a successful attempt.
+func (b *backoff) reset() {
+	b.attempts = 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffNext(t *testing.T) {
+	b := newBackoff(time.Second, 5*time.Second, 0)
+
+	// Each wait is in the upper half of an interval which doubles up to max.
+	intervals := []time.Duration{1, 2, 4, 5, 5}
+	for i, interval := range intervals {
+		interval *= time.Second
+		wait, ok := b.next()
+		if !ok {
+			t.Fatalf("attempt %d: gave up without a maximum number of attempts", i+1)
+		}
+		if wait < interval/2 || wait > interval {
+			t.Errorf("attempt %d: got wait %s, want between %s and %s", i+1, wait, interval/2, interval)
+		}
+	}
+
+	b.reset()
+	if wait, _ := b.next(); wait > time.Second {
+		t.Errorf("after reset got wait %s, want at most 1s", wait)
+	}
+}
+
+func TestBackoffMaxAttempts(t *testing.T) {
+	b := newBackoff(time.Millisecond, time.Millisecond, 3)
+	for i := 1; i < 3; i++ {
+		if _, ok := b.next(); !ok {
+			t.Fatalf("gave up after %d attempts, want 3", i)
+		}
+	}
+	if _, ok := b.next(); ok {
+		t.Error("did not give up after 3 attempts")
+	}
+
+	b.reset()
+	if _, ok := b.next(); !ok {
+		t.Error("gave up straight after reset")
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	b := newBackoff(0, 0, 0)
+	if b.initial != defaultReconnectInterval || b.max != defaultMaxReconnectInterval {
+		t.Errorf("got initial %s and max %s, want the defaults", b.initial, b.max)
+	}
+
+	b = newBackoff(10*time.Second, time.Second, 0)
+	if b.max != b.initial {
+		t.Errorf("got max %s below initial %s", b.max, b.initial)
+	}
+}
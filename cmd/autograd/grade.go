@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/PrairieLearn/autograd/amqp"
+	"github.com/PrairieLearn/autograd/grader"
+)
+
+// runGrade implements "autograd grade": it grades one job against a local
+// grader repo checkout, the same way the agent does, and prints the result.
+// It returns the process exit code.
+func runGrade(args []string) int {
+	flags := flag.NewFlagSet("grade", flag.ExitOnError)
+	jobPath := flags.String("job", "", "path to the job data JSON file (required)")
+	graderRoot := flags.String("grader-root", ".", "path to the grader repo checkout")
+	autogradRoot := flags.String("autograd-root", "",
+		"directory for job directories (default $AUTOGRAD_ROOT, or a temporary directory)")
+	flags.Parse(args)
+
+	if *jobPath == "" {
+		fmt.Fprintln(os.Stderr, "autograd grade: -job is required")
+		flags.Usage()
+		return 2
+	}
+
+	result, err := gradeLocally(*jobPath, *graderRoot, *autogradRoot)
+	if err != nil {
+		log.Errorf("Failed to grade job: %s", err)
+		return 1
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Errorf("Failed to encode result: %s", err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
+
+func gradeLocally(jobPath, graderRoot, autogradRoot string) (*grader.Result, error) {
+	jobData, err := ioutil.ReadFile(jobPath)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := amqp.ParseGID(jobData)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing gid from job data: %v", err)
+	}
+
+	graderRoot, err = filepath.Abs(graderRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	autogradRoot, cleanup, err := localAutogradRoot(autogradRoot)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	// Command output goes to stderr, keeping stdout for the result.
+	g, err := loadGrader(autogradRoot, graderRoot, "", os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load grader config: %v", err)
+	}
+
+	ctx, stop := cancelOnInterrupt()
+	defer stop()
+
+	return g.Grade(ctx, gid, jobData)
+}
+
+// cancelOnInterrupt returns a context which is canceled on SIGINT or SIGTERM,
+// so that running commands are stopped and cleaned up, and a func to stop
+// watching for them.
+func cancelOnInterrupt() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Info("Interrupted, stopping grader")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(interrupt)
+		cancel()
+	}
+}
+
+// localAutogradRoot returns the directory job directories are created in:
+// root if set, then $AUTOGRAD_ROOT, then a temporary directory which is
+// removed by the returned cleanup func.
+func localAutogradRoot(root string) (string, func(), error) {
+	if root == "" {
+		root = os.Getenv("AUTOGRAD_ROOT")
+	}
+
+	cleanup := func() {}
+	if root == "" {
+		dir, err := ioutil.TempDir("", "autograd")
+		if err != nil {
+			return "", nil, err
+		}
+		root = dir
+		cleanup = func() { os.RemoveAll(dir) }
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return root, cleanup, nil
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -11,15 +14,70 @@ import (
 	"github.com/PrairieLearn/autograd/amqp"
 	"github.com/PrairieLearn/autograd/config"
 	"github.com/PrairieLearn/autograd/grader"
-	graderconfig "github.com/PrairieLearn/autograd/grader/config"
 	"github.com/PrairieLearn/autograd/repo"
 )
 
+// defaultShutdownTimeout is how long the agent finishes the jobs in progress
+// after SIGTERM before requeueing them, leaving time to requeue them within
+// the default Kubernetes termination grace period of 30 seconds.
+const defaultShutdownTimeout = 20 * time.Second
+
+// stableConnectionPeriod is how long an AMQP connection must stay up before
+// losing it resets the reconnect backoff.
+const stableConnectionPeriod = time.Minute
+
 func init() {
 	log.SetLevel(log.DebugLevel)
 }
 
+const usage = `Usage:
+  autograd [agent] [flags]  Run the grading agent
+  autograd grade [flags]    Grade a single job locally
+  autograd regrade [flags]  Grade a batch of jobs locally
+  autograd selftest [flags] Grade the self-test fixtures of a grader repo
+  autograd validate-config [flags]
+                            Check configuration files for problems
+
+Run "autograd <command> -h" for the flags of a command.
+`
+
 func main() {
+	if len(os.Args) < 2 {
+		runAgent(nil)
+		return
+	}
+
+	switch os.Args[1] {
+	case "agent":
+		runAgent(os.Args[2:])
+	case "grade":
+		os.Exit(runGrade(os.Args[2:]))
+	case "regrade":
+		os.Exit(runRegrade(os.Args[2:]))
+	case "selftest":
+		os.Exit(runSelfTestCommand(os.Args[2:]))
+	case "validate-config":
+		os.Exit(runValidateConfig(os.Args[2:]))
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stderr, usage)
+	default:
+		if strings.HasPrefix(os.Args[1], "-") {
+			runAgent(os.Args[1:])
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+// runAgent grades jobs from the grading queue until it receives SIGTERM.
+// Flags and AUTOGRAD_* environment variables override the configuration
+// file, with flags taking precedence.
+func runAgent(args []string) {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	flagOverrides := config.RegisterFlags(flags)
+	flags.Parse(args)
+
 	autogradRoot, err := config.GetAutogradRoot()
 	if err != nil {
 		log.Fatalf("Failed to get autograd root: %s", err)
@@ -27,76 +85,139 @@ func main() {
 
 	log.Printf("Starting autograd agent at %s", autogradRoot)
 
-	cfg, err := config.Load(autogradRoot)
+	overrides, err := config.EnvOverrides()
 	if err != nil {
-		log.Fatalf("Failed to load autograd config: %s", err)
+		log.Fatalf("Failed to read autograd config from environment: %s", err)
+	}
+	config.ClearEnvOverrides()
+	fromFlags, err := flagOverrides()
+	if err != nil {
+		log.Fatalf("Failed to read autograd config from flags: %s", err)
 	}
+	overrides = append(overrides, fromFlags...)
 
-	err = repo.Sync(
-		cfg.GraderRepo.RepoURL,
-		cfg.GraderRepo.Commit,
-		autogradRoot,
-		cfg.GraderRepo.Credentials.PublicKey,
-		cfg.GraderRepo.Credentials.PrivateKey,
-		cfg.GraderRepo.Credentials.Passphrase)
+	cfg, err := config.Load(autogradRoot, overrides)
 	if err != nil {
+		log.Fatalf("Failed to load autograd config: %s", err)
+	}
+
+	status := newAgentStatus()
+	if cfg.HTTP.Listen != "" {
+		go serveStatus(cfg.HTTP.Listen, status)
+	}
+
+	if err := syncGraderRepo(cfg, autogradRoot); err != nil {
 		log.Fatalf("Failed to sync grader repo: %s", err)
 	}
+	status.setRepoSynced()
 
-	graderRoot := grader.GetGraderRoot(autogradRoot)
+	commit, err := repo.Head(autogradRoot)
+	if err != nil {
+		log.Fatalf("Failed to get grader repo commit: %s", err)
+	}
 
-	graderCfg, err := graderconfig.Load(graderRoot)
+	graderRoot := grader.GetGraderRoot(autogradRoot)
+	g, err := loadGrader(autogradRoot, graderRoot, commit, os.Stdout)
 	if err != nil {
 		log.Fatalf("Failed to load grader config: %s", err)
 	}
+	if cfg.GraderRepo.RequireSelfTest {
+		if err := selfTest(g); err != nil {
+			log.Fatalf("Refusing to grade jobs: %s", err)
+		}
+	}
+	status.setLoaded(commit, g.InitFailures())
 
-	grader.RunCommands(
-		graderCfg.Grader.InitCommands,
-		graderRoot,
-		map[string]string{"AUTOGRAD_GRADER_ROOT": graderRoot},
-		"",
-		grader.InitStage)
-
-	grader := grader.New(
-		autogradRoot,
-		graderCfg.Grader.SetupCommands,
-		graderCfg.Grader.GradeCommand,
-		graderCfg.Grader.CleanupCommands,
-		graderCfg.Grader.GradeTimeout)
-
-	sigterm := make(chan os.Signal)
+	revisions := newRevisionGrader(cfg, autogradRoot, graderRoot, commit, g)
+	go watchGraderRepo(cfg, autogradRoot, revisions, status)
+
+	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, syscall.SIGTERM)
 
+	reconnect := newBackoff(
+		time.Duration(cfg.AMQP.ReconnectInterval)*time.Second,
+		time.Duration(cfg.AMQP.MaxReconnectInterval)*time.Second,
+		cfg.AMQP.MaxReconnectAttempts)
+
+	// waitToReconnect waits out the backoff after a failed or lost
+	// connection, returning false if SIGTERM arrives first.
+	waitToReconnect := func(message string, err error) bool {
+		wait, ok := reconnect.next()
+		fields := log.Fields{"attempt": reconnect.attempts}
+		if !ok {
+			log.WithFields(fields).Fatalf("%s, giving up: %s", message, err)
+		}
+		log.WithFields(fields).Warnf("%s, retrying in %s: %s", message, wait, err)
+
+		select {
+		case <-time.After(wait):
+			return true
+		case <-sigterm:
+			log.Info("Received SIGTERM while reconnecting, exiting")
+			return false
+		}
+	}
+
 	isRunning := true
 	for isRunning {
-		c, err := amqp.NewClient(
-			cfg.AMQP.URL,
-			cfg.AMQP.GradingQueue,
-			cfg.AMQP.StartedQueue,
-			cfg.AMQP.ResultQueue,
-			grader)
+		c, err := amqp.NewClient(cfg.AMQP, revisions)
 		if err != nil {
-			log.Warnf("Error initializing AMQP client: %s", err)
-			time.Sleep(1 * time.Second)
+			isRunning = waitToReconnect("Error initializing AMQP client", err)
 			continue
 		}
+		connected := time.Now()
 
 		log.WithFields(log.Fields{
 			"queue": cfg.AMQP.GradingQueue,
 		}).Info("Listening for grading jobs")
+		status.setConsuming(true)
 
+		var closeErr error
 		select {
 		case err := <-c.NotifyClose():
 			log.Warnf("Closing client: %s", err)
+			amqpReconnects.Inc()
+			closeErr = err
+			// A connection which stayed up for a while worked, so a new
+			// connection starts the backoff over. One which was dropped
+			// soon after it was made counts as another failed attempt.
+			if time.Since(connected) >= stableConnectionPeriod {
+				reconnect.reset()
+			}
 		case <-sigterm:
-			log.Info("Received SIGTERM, finishing last job")
 			isRunning = false
+			if cfg.AMQP.ShutdownMode == config.ShutdownRequeue {
+				log.Info("Received SIGTERM, requeueing last job")
+				c.Abort()
+				break
+			}
+
+			timeout := defaultShutdownTimeout
+			if cfg.AMQP.ShutdownTimeout > 0 {
+				timeout = time.Duration(cfg.AMQP.ShutdownTimeout) * time.Second
+			}
+			log.Infof("Received SIGTERM, finishing last job (requeueing it after %s or on another SIGTERM)",
+				timeout)
+			go func() {
+				select {
+				case <-sigterm:
+					log.Info("Received SIGTERM, requeueing last job")
+				case <-time.After(timeout):
+					log.Info("Shutdown timeout reached, requeueing last job")
+				}
+				c.Abort()
+			}()
 		}
 
+		status.setConsuming(false)
 		log.Infof("Shutting down AMQP connection")
 
 		if err := c.Shutdown(); err != nil {
 			log.Warnf("Error during shutdown: %s", err)
 		}
+
+		if isRunning {
+			isRunning = waitToReconnect("AMQP connection closed", closeErr)
+		}
 	}
 }
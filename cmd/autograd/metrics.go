@@ -0,0 +1,12 @@
+package main
+
+import (
+	"github.com/PrairieLearn/autograd/metrics"
+)
+
+var (
+	amqpReconnects = metrics.NewCounter("autograd_amqp_reconnects_total",
+		"Times the AMQP client was recreated after its connection closed.")
+	graderCommit = metrics.NewGauge("autograd_grader_commit_info",
+		"Grader repo commit used for jobs without a grader_commit, as the commit label.", "commit")
+)
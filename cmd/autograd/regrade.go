@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/PrairieLearn/autograd/amqp"
+	"github.com/PrairieLearn/autograd/grader"
+)
+
+// maxJobLineSize is the longest line accepted in a JSONL file of jobs or
+// results.
+const maxJobLineSize = 64 << 20
+
+// regradeJob is one job to regrade, with where it came from for error
+// messages.
+type regradeJob struct {
+	source string
+	data   []byte
+}
+
+// regradeResult is one line of the regrade output. OldScore and ScoreDiff
+// are only set if an old result was supplied for the job.
+type regradeResult struct {
+	GID       string         `json:"gid"`
+	Source    string         `json:"source"`
+	Result    *grader.Result `json:"result,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	OldScore  *float64       `json:"old_score,omitempty"`
+	ScoreDiff *float64       `json:"score_diff,omitempty"`
+}
+
+// runRegrade implements "autograd regrade": it grades a batch of jobs
+// against a local grader repo checkout and writes their results as JSONL.
+// It returns the process exit code.
+func runRegrade(args []string) int {
+	flags := flag.NewFlagSet("regrade", flag.ExitOnError)
+	jobsPath := flags.String("jobs", "", "directory of job data JSON files, or a JSONL file of jobs (required)")
+	graderRoot := flags.String("grader-root", ".", "path to the grader repo checkout")
+	autogradRoot := flags.String("autograd-root", "",
+		"directory for job directories (default $AUTOGRAD_ROOT, or a temporary directory)")
+	outputPath := flags.String("output", "", "JSONL file to write results to (default stdout)")
+	oldResultsPath := flags.String("old-results", "", "JSONL file of previous results to compare scores with")
+	workers := flags.Int("workers", 1, "number of jobs to grade concurrently")
+	flags.Parse(args)
+
+	if *jobsPath == "" {
+		fmt.Fprintln(os.Stderr, "autograd regrade: -jobs is required")
+		flags.Usage()
+		return 2
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	jobs, err := readJobs(*jobsPath)
+	if err != nil {
+		log.Errorf("Failed to read jobs: %s", err)
+		return 1
+	}
+
+	var oldScores map[string]float64
+	if *oldResultsPath != "" {
+		if oldScores, err = readOldScores(*oldResultsPath); err != nil {
+			log.Errorf("Failed to read old results: %s", err)
+			return 1
+		}
+	}
+
+	out := os.Stdout
+	if *outputPath != "" {
+		f, err := os.Create(*outputPath)
+		if err != nil {
+			log.Errorf("Failed to create output file: %s", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	graderRootPath, err := filepath.Abs(*graderRoot)
+	if err != nil {
+		log.Errorf("Failed to resolve grader root: %s", err)
+		return 1
+	}
+	root, cleanup, err := localAutogradRoot(*autogradRoot)
+	if err != nil {
+		log.Errorf("Failed to create autograd root: %s", err)
+		return 1
+	}
+	defer cleanup()
+
+	// Command output goes to stderr, keeping stdout for the results.
+	g, err := loadGrader(root, graderRootPath, "", os.Stderr)
+	if err != nil {
+		log.Errorf("Failed to load grader config: %s", err)
+		return 1
+	}
+
+	ctx, stop := cancelOnInterrupt()
+	defer stop()
+	failed, changed, skipped := regrade(ctx, g, jobs, *workers, oldScores, out)
+
+	fields := log.Fields{
+		"jobs":    len(jobs),
+		"failed":  failed,
+		"changed": changed,
+		"skipped": skipped,
+	}
+	if skipped > 0 {
+		log.WithFields(fields).Errorf("Regrade interrupted, %d jobs were not graded", skipped)
+		return 1
+	}
+	log.WithFields(fields).Info("Regrade finished")
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// regrade grades jobs with the given number of workers, writing a line to
+// out for each as it finishes. It returns the number of jobs which could not
+// be graded, the number whose score differs from oldScores and the number
+// which were not started because ctx was canceled.
+func regrade(ctx context.Context, g *grader.Grader, jobs []regradeJob, workers int,
+	oldScores map[string]float64, out io.Writer) (failed, changed, skipped int) {
+
+	queue := make(chan regradeJob)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				r := regradeResult{Source: job.source}
+				gid, err := amqp.ParseGID(job.data)
+				if err == nil {
+					r.GID = gid
+					r.Result, err = g.Grade(ctx, gid, job.data)
+				}
+				if err != nil {
+					r.Error = err.Error()
+				} else if old, ok := oldScores[gid]; ok {
+					diff := r.Result.Grading.Score - old
+					r.OldScore = &old
+					r.ScoreDiff = &diff
+				}
+
+				line, err := json.Marshal(r)
+				if err != nil {
+					line, _ = json.Marshal(regradeResult{GID: r.GID, Source: r.Source, Error: err.Error()})
+				}
+
+				mu.Lock()
+				if r.Error != "" {
+					failed++
+				}
+				if r.ScoreDiff != nil && *r.ScoreDiff != 0 {
+					changed++
+				}
+				fmt.Fprintln(out, string(line))
+				mu.Unlock()
+			}
+		}()
+	}
+
+	dispatched := 0
+dispatch:
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case queue <- job:
+			dispatched++
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return failed, changed, len(jobs) - dispatched
+}
+
+// readJobs reads jobs from every .json file in a directory, or from each
+// line of a JSONL file.
+func readJobs(path string) ([]regradeJob, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		var jobs []regradeJob
+		err := readJSONL(path, func(source string, line []byte) error {
+			jobs = append(jobs, regradeJob{source: source, data: line})
+			return nil
+		})
+		return jobs, err
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	jobs := make([]regradeJob, len(names))
+	for i, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(path, name))
+		if err != nil {
+			return nil, err
+		}
+		jobs[i] = regradeJob{source: name, data: data}
+	}
+	return jobs, nil
+}
+
+// readOldScores reads the score of each result in a JSONL file of results,
+// by gid. A line is either a result as published to the result queue, or a
+// line of regrade output, whose jobs that could not be graded are skipped.
+func readOldScores(path string) (map[string]float64, error) {
+	type grading struct {
+		Score *float64 `json:"score"`
+	}
+	scores := make(map[string]float64)
+	err := readJSONL(path, func(source string, line []byte) error {
+		var result struct {
+			GID     string  `json:"gid"`
+			Grading grading `json:"grading"`
+			Result  *struct {
+				Grading grading `json:"grading"`
+			} `json:"result"`
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(line, &result); err != nil {
+			return fmt.Errorf("%s: %v", source, err)
+		}
+		if result.Error != "" {
+			return nil
+		}
+
+		score := result.Grading.Score
+		if result.Result != nil {
+			score = result.Result.Grading.Score
+		}
+		if result.GID == "" || score == nil {
+			return fmt.Errorf("%s: result has no gid or score", source)
+		}
+		scores[result.GID] = *score
+		return nil
+	})
+	return scores, err
+}
+
+// readJSONL calls fn with each non-empty line of a file, and the file name and
+// line number as its source.
+func readJSONL(path string, fn func(source string, line []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxJobLineSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", filepath.Base(path), n)
+		if err := fn(source, append([]byte{}, line...)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PrairieLearn/autograd/grader"
+)
+
+// newTestRegradeGrader returns a grader whose grade command exits with
+// score, which is then the score of each job it grades.
+func newTestRegradeGrader(t *testing.T, score string) *grader.Grader {
+	root, err := ioutil.TempDir("", "regrade_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	g := grader.New(root, root, nil, []string{"sh", "-c", "exit " + score}, nil, 10)
+	g.SetOutputLog(ioutil.Discard)
+	return g
+}
+
+func TestRegradeComparesWithEarlierRegrade(t *testing.T) {
+	jobs := []regradeJob{
+		{source: "jobs.jsonl:1", data: []byte(`{"gid": "g1"}`)},
+		{source: "jobs.jsonl:2", data: []byte(`not json`)},
+	}
+
+	var first bytes.Buffer
+	failed, _, _ := regrade(context.Background(), newTestRegradeGrader(t, "3"), jobs, 1, nil, &first)
+	if failed != 1 {
+		t.Fatalf("first regrade: got %d failed jobs, want 1", failed)
+	}
+
+	dir, err := ioutil.TempDir("", "regrade_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldResults := filepath.Join(dir, "old_results.jsonl")
+	if err := ioutil.WriteFile(oldResults, first.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldScores, err := readOldScores(oldResults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var second bytes.Buffer
+	_, changed, _ := regrade(context.Background(), newTestRegradeGrader(t, "5"), jobs, 1, oldScores, &second)
+	if changed != 1 {
+		t.Errorf("second regrade: got %d changed jobs, want 1", changed)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(second.String()), "\n") {
+		var r regradeResult
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.GID != "g1" {
+			continue
+		}
+		if r.OldScore == nil || *r.OldScore != 3 || r.ScoreDiff == nil || *r.ScoreDiff != 2 {
+			t.Errorf("got old score %v and score diff %v, want 3 and 2", r.OldScore, r.ScoreDiff)
+		}
+	}
+}
+
+func TestReadOldScoresRejectsResultsWithoutScore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regrade_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "old_results.jsonl")
+	if err := ioutil.WriteFile(path, []byte(`{"gid": "g1", "grading": {"score": 1}}
+{"gid": "g2", "result": {"grading": {}}}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readOldScores(path); err == nil || !strings.Contains(err.Error(), "old_results.jsonl:2") {
+		t.Errorf("got error %v, want one for line 2", err)
+	}
+}
+
+func TestRegradeReportsSkippedJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	jobs := []regradeJob{
+		{source: "g1.json", data: []byte(`{"gid": "g1"}`)},
+		{source: "g2.json", data: []byte(`{"gid": "g2"}`)},
+	}
+
+	var out bytes.Buffer
+	if _, _, skipped := regrade(ctx, newTestRegradeGrader(t, "0"), jobs, 1, nil, &out); skipped != len(jobs) {
+		t.Errorf("got %d skipped jobs, want %d", skipped, len(jobs))
+	}
+}
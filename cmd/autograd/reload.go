@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/PrairieLearn/autograd/config"
+	"github.com/PrairieLearn/autograd/grader"
+	graderconfig "github.com/PrairieLearn/autograd/grader/config"
+	"github.com/PrairieLearn/autograd/repo"
+)
+
+func syncGraderRepo(cfg *config.Config, autogradRoot string) error {
+	return repo.Sync(
+		cfg.GraderRepo.RepoURL,
+		cfg.GraderRepo.Commit,
+		autogradRoot,
+		cfg.GraderRepo.Credentials.PublicKey,
+		cfg.GraderRepo.Credentials.PrivateKey,
+		cfg.GraderRepo.Credentials.Passphrase)
+}
+
+// loadGrader loads the grader config from a checkout of commit of the grader
+// repo, runs its init commands and returns a Grader for it. The output of
+// its commands is written to outputLog.
+func loadGrader(autogradRoot, graderRoot, commit string, outputLog io.Writer) (*grader.Grader, error) {
+	graderCfg, err := graderconfig.Load(graderRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	initCommands, err := toCommands(graderCfg.Grader.InitCommands)
+	if err != nil {
+		return nil, err
+	}
+	setupCommands, err := toCommands(graderCfg.Grader.SetupCommands)
+	if err != nil {
+		return nil, err
+	}
+	cleanupCommands, err := toCommands(graderCfg.Grader.CleanupCommands)
+	if err != nil {
+		return nil, err
+	}
+	fixtures, err := toFixtures(graderCfg.Grader.SelfTest, graderRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	killGrace := grader.DefaultKillGracePeriod
+	if graderCfg.Grader.KillGracePeriod != nil {
+		killGrace = time.Duration(*graderCfg.Grader.KillGracePeriod) * time.Second
+	}
+
+	g := grader.New(
+		autogradRoot,
+		graderRoot,
+		setupCommands,
+		graderCfg.Grader.GradeCommand,
+		cleanupCommands,
+		graderCfg.Grader.GradeTimeout)
+	for name, p := range graderCfg.Grader.Profiles {
+		setupCommands, err := toCommands(p.SetupCommands)
+		if err != nil {
+			return nil, err
+		}
+		cleanupCommands, err := toCommands(p.CleanupCommands)
+		if err != nil {
+			return nil, err
+		}
+		g.AddProfile(name, setupCommands, p.GradeCommand, cleanupCommands, p.GradeTimeout)
+	}
+	if sandbox := graderCfg.Grader.Sandbox; sandbox.Enabled {
+		g.EnableSandbox(sandbox.ReadOnlyPaths, sandbox.AllowNetwork, sandbox.UIDBase)
+	}
+	stageLimits := map[grader.Stage]graderconfig.StageLimitsConfig{
+		grader.InitStage:    graderCfg.Grader.Limits.Init,
+		grader.SetupStage:   graderCfg.Grader.Limits.Setup,
+		grader.GradeStage:   graderCfg.Grader.Limits.Grade,
+		grader.CleanupStage: graderCfg.Grader.Limits.Cleanup,
+	}
+	for stage, limits := range stageLimits {
+		if err := g.SetLimits(stage, toLimits(limits)); err != nil {
+			return nil, err
+		}
+	}
+	output := graderCfg.Grader.Output
+	stageOutput := map[grader.Stage]graderconfig.StageOutputConfig{
+		grader.InitStage:    output.Init,
+		grader.SetupStage:   output.Setup,
+		grader.GradeStage:   output.Grade,
+		grader.CleanupStage: output.Cleanup,
+	}
+	for stage, cfg := range stageOutput {
+		limit := grader.OutputLimit{
+			HeadBytes: output.HeadBytes,
+			TailBytes: output.TailBytes,
+			SpillDir:  output.SpillDir,
+		}
+		if cfg.HeadBytes > 0 {
+			limit.HeadBytes = cfg.HeadBytes
+		}
+		if cfg.TailBytes > 0 {
+			limit.TailBytes = cfg.TailBytes
+		}
+		g.SetOutputLimit(stage, limit)
+	}
+	streams := make([]grader.FeedbackStream, len(output.Streams))
+	for i, stream := range output.Streams {
+		streams[i] = grader.FeedbackStream(stream)
+	}
+	if err := g.SetFeedback(grader.FeedbackStream(output.Feedback), streams, output.Timestamps); err != nil {
+		return nil, err
+	}
+	if err := g.SetResults(graderCfg.Grader.ResultsFile, graderCfg.Grader.PartialResults); err != nil {
+		return nil, err
+	}
+	g.SetKillGracePeriod(killGrace)
+	g.SetCommit(commit)
+	for _, f := range fixtures {
+		g.AddFixture(f)
+	}
+
+	g.SetOutputLog(outputLog)
+
+	if err := g.RunInit(context.Background(), initCommands); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func toCommands(cfg []graderconfig.Command) ([]grader.Command, error) {
+	commands := make([]grader.Command, len(cfg))
+	for i, c := range cfg {
+		policy, retries, err := graderconfig.ParseFailurePolicy(c.OnFailure)
+		if err != nil {
+			return nil, err
+		}
+		if c.AllowFailure {
+			policy = graderconfig.FailureContinue
+		}
+		commands[i] = grader.Command{
+			Argv:      c.Command,
+			OnFailure: grader.FailurePolicy(policy),
+			Retries:   retries,
+			Timeout:   time.Duration(c.Timeout) * time.Second,
+			Env:       c.Env,
+			Dir:       c.Dir,
+		}
+	}
+	return commands, nil
+}
+
+func toLimits(cfg graderconfig.StageLimitsConfig) grader.Limits {
+	return grader.Limits{
+		AddressSpace: cfg.AddressSpaceMB << 20,
+		CPUTime:      cfg.CPUSeconds,
+		Memory:       cfg.MemoryMB << 20,
+		Processes:    cfg.Processes,
+		FileSize:     cfg.FileSizeMB << 20,
+		OpenFiles:    cfg.OpenFiles,
+	}
+}
+
+// watchGraderRepo checks for a new commit of the grader repo every
+// poll_interval seconds and on SIGHUP, and reloads the grader when the
+// configured commit has moved.
+func watchGraderRepo(cfg *config.Config, autogradRoot string, revisions *revisionGrader, status *agentStatus) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	var poll <-chan time.Time
+	if cfg.GraderRepo.PollInterval > 0 {
+		poll = time.NewTicker(time.Duration(cfg.GraderRepo.PollInterval) * time.Second).C
+	}
+
+	for {
+		select {
+		case <-poll:
+		case <-sighup:
+			log.Info("Received SIGHUP, checking grader repo")
+		}
+
+		if err := reloadIfMoved(cfg, autogradRoot, revisions, status); err != nil {
+			log.Warnf("Failed to reload grader, will retry at the next check: %s", err)
+		}
+	}
+}
+
+// reloadIfMoved fetches the grader repo and reloads the grader if the
+// configured commit is not the one being graded against. The commit is
+// compared with the current revision rather than the grader repo's HEAD, so
+// a reload which failed is retried at the next check.
+func reloadIfMoved(cfg *config.Config, autogradRoot string, revisions *revisionGrader, status *agentStatus) error {
+	commit, err := repo.Fetch(
+		cfg.GraderRepo.RepoURL,
+		cfg.GraderRepo.Commit,
+		autogradRoot,
+		cfg.GraderRepo.Credentials.PublicKey,
+		cfg.GraderRepo.Credentials.PrivateKey,
+		cfg.GraderRepo.Credentials.Passphrase)
+	if err != nil {
+		return err
+	}
+
+	current := revisions.currentCommit()
+	if commit == current {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"from": current,
+		"to":   commit,
+	}).Info("Grader repo moved, loading new commit")
+
+	g, err := revisions.reload(commit)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"commit": commit,
+	}).Info("Reloaded grader")
+	status.setLoaded(commit, g.InitFailures())
+	return nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/PrairieLearn/autograd/config"
+	"github.com/PrairieLearn/autograd/grader"
+	"github.com/PrairieLearn/autograd/repo"
+)
+
+const (
+	revisionsDir             = "_grader_revisions"
+	defaultRevisionCacheSize = 4
+)
+
+// revisionGrader grades jobs which name a grader repo commit in their
+// grader_commit field against a checkout of that commit, keeping the most
+// recently used checkouts around. Other jobs are graded by the current
+// revision, which is replaced when the grader repo moves.
+type revisionGrader struct {
+	cfg          *config.Config
+	autogradRoot string
+	cacheSize    int
+
+	mu        sync.Mutex
+	current   *revision // holds a use of the revision, so it is not evicted
+	revisions map[string]*revision
+	lru       *list.List // of *revision, most recently used at the front
+}
+
+type revision struct {
+	commit string
+	dir    string
+	grader *grader.Grader
+	err    error
+	ready  chan struct{} // closed once grader or err is set
+	users  int
+	elem   *list.Element
+}
+
+// newRevisionGrader returns a revisionGrader whose current revision is g,
+// loaded from the checkout of commit at graderRoot.
+func newRevisionGrader(cfg *config.Config, autogradRoot, graderRoot, commit string, g *grader.Grader) *revisionGrader {
+	cacheSize := cfg.GraderRepo.RevisionCacheSize
+	if cacheSize < 1 {
+		cacheSize = defaultRevisionCacheSize
+	}
+
+	// Checkouts left over from a previous run may be incomplete.
+	if err := os.RemoveAll(filepath.Join(autogradRoot, revisionsDir)); err != nil {
+		log.Warnf("Error removing grader revisions: %v", err)
+	}
+
+	// The startup revision is checked out in the grader root rather than
+	// the revision cache, so it is never evicted.
+	current := &revision{
+		commit: commit,
+		dir:    graderRoot,
+		grader: g,
+		ready:  make(chan struct{}),
+		users:  1,
+	}
+	close(current.ready)
+
+	return &revisionGrader{
+		cfg:          cfg,
+		autogradRoot: autogradRoot,
+		cacheSize:    cacheSize,
+		current:      current,
+		revisions:    make(map[string]*revision),
+		lru:          list.New(),
+	}
+}
+
+func (r *revisionGrader) Grade(ctx context.Context, gid string, jobData []byte) (*grader.Result, error) {
+	commit, err := parseGraderCommit(jobData)
+	if err != nil {
+		return nil, err
+	}
+
+	var rev *revision
+	if commit == "" {
+		r.mu.Lock()
+		rev = r.current
+		rev.users++
+		r.mu.Unlock()
+	} else {
+		rev, err = r.acquire(commit)
+		if err != nil {
+			return nil, err
+		}
+
+		log.WithFields(log.Fields{
+			"gid":    gid,
+			"commit": rev.commit,
+		}).Info("Grading against pinned grader revision")
+	}
+	defer r.release(rev)
+
+	return rev.grader.Grade(ctx, gid, jobData)
+}
+
+// currentCommit returns the commit of the current revision.
+func (r *revisionGrader) currentCommit() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.current.commit
+}
+
+// reload checks out commit into the revision cache, loads it and, once it
+// has been initialized, makes it the current revision. Jobs already running
+// finish on the old revision, and the old revision keeps grading new jobs
+// until the swap, or for good if the new one fails to load. It returns the
+// new revision's grader.
+func (r *revisionGrader) reload(commit string) (*grader.Grader, error) {
+	rev, err := r.acquire(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	old := r.current
+	r.current = rev
+	r.mu.Unlock()
+
+	r.release(old)
+	return rev.grader, nil
+}
+
+// acquire returns the checkout of commit, creating it if it is not cached.
+// The checkout is not evicted until it is released.
+func (r *revisionGrader) acquire(commit string) (*revision, error) {
+	id, err := r.resolve(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	rev, ok := r.revisions[id]
+	if ok {
+		rev.users++
+		r.lru.MoveToFront(rev.elem)
+		r.mu.Unlock()
+		<-rev.ready
+	} else {
+		rev = &revision{
+			commit: id,
+			dir:    filepath.Join(r.autogradRoot, revisionsDir, id),
+			ready:  make(chan struct{}),
+			users:  1,
+		}
+		rev.elem = r.lru.PushFront(rev)
+		r.revisions[id] = rev
+		r.mu.Unlock()
+
+		rev.grader, rev.err = r.load(rev)
+		if rev.err != nil {
+			r.mu.Lock()
+			delete(r.revisions, id)
+			r.lru.Remove(rev.elem)
+			r.mu.Unlock()
+		}
+		close(rev.ready)
+	}
+
+	if rev.err != nil {
+		r.release(rev)
+		return nil, rev.err
+	}
+	return rev, nil
+}
+
+func (r *revisionGrader) release(rev *revision) {
+	r.mu.Lock()
+	rev.users--
+	r.mu.Unlock()
+
+	r.evict()
+}
+
+// evict removes the least recently used checkouts not in use until the cache
+// is back to its configured size.
+func (r *revisionGrader) evict() {
+	var evicted []*revision
+
+	r.mu.Lock()
+	for e := r.lru.Back(); e != nil && r.lru.Len() > r.cacheSize; {
+		rev := e.Value.(*revision)
+		e = e.Prev()
+		if rev.users > 0 {
+			continue
+		}
+		delete(r.revisions, rev.commit)
+		r.lru.Remove(rev.elem)
+		evicted = append(evicted, rev)
+	}
+	r.mu.Unlock()
+
+	for _, rev := range evicted {
+		log.Infof("Evicting grader revision %s", rev.commit)
+		if err := os.RemoveAll(rev.dir); err != nil {
+			log.Warnf("Error removing grader revision: %v", err)
+		}
+	}
+}
+
+// resolve returns the commit id for commit, fetching the grader repo if the
+// commit is not known locally. Branch names resolve to the branch as of the
+// last fetch.
+func (r *revisionGrader) resolve(commit string) (string, error) {
+	if id, err := repo.Resolve(commit, r.autogradRoot); err == nil {
+		return id, nil
+	}
+
+	return repo.Fetch(
+		r.cfg.GraderRepo.RepoURL,
+		commit,
+		r.autogradRoot,
+		r.cfg.GraderRepo.Credentials.PublicKey,
+		r.cfg.GraderRepo.Credentials.PrivateKey,
+		r.cfg.GraderRepo.Credentials.Passphrase)
+}
+
+// load checks out a revision and loads its grader, which must pass its
+// self-test if one is required, whether the revision is to become the
+// current one or was pinned by a job.
+func (r *revisionGrader) load(rev *revision) (*grader.Grader, error) {
+	log.Infof("Checking out grader revision %s", rev.commit)
+
+	if err := os.RemoveAll(rev.dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(rev.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := repo.Checkout(rev.commit, r.autogradRoot, rev.dir); err != nil {
+		os.RemoveAll(rev.dir)
+		return nil, err
+	}
+
+	g, err := loadGrader(r.autogradRoot, rev.dir, rev.commit, os.Stdout)
+	if err == nil && r.cfg.GraderRepo.RequireSelfTest {
+		err = selfTest(g)
+	}
+	if err != nil {
+		os.RemoveAll(rev.dir)
+		return nil, err
+	}
+	return g, nil
+}
+
+func parseGraderCommit(jobData []byte) (string, error) {
+	var job struct {
+		GraderCommit string `json:"grader_commit"`
+	}
+	err := json.Unmarshal(jobData, &job)
+	if err != nil {
+		return "", err
+	}
+	return job.GraderCommit, nil
+}
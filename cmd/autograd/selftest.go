@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/PrairieLearn/autograd/grader"
+	graderconfig "github.com/PrairieLearn/autograd/grader/config"
+)
+
+// runSelfTestCommand implements "autograd selftest": it grades the self-test
+// fixtures of a local grader repo checkout and reports which failed. It
+// returns the process exit code.
+func runSelfTestCommand(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	graderRoot := flags.String("grader-root", ".", "path to the grader repo checkout")
+	autogradRoot := flags.String("autograd-root", "",
+		"directory for job directories (default $AUTOGRAD_ROOT, or a temporary directory)")
+	flags.Parse(args)
+
+	graderRootPath, err := filepath.Abs(*graderRoot)
+	if err != nil {
+		log.Errorf("Failed to resolve grader root: %s", err)
+		return 1
+	}
+	root, cleanup, err := localAutogradRoot(*autogradRoot)
+	if err != nil {
+		log.Errorf("Failed to create autograd root: %s", err)
+		return 1
+	}
+	defer cleanup()
+
+	// Command output goes to stderr, keeping stdout for the report.
+	g, err := loadGrader(root, graderRootPath, "", os.Stderr)
+	if err != nil {
+		log.Errorf("Failed to load grader config: %s", err)
+		return 1
+	}
+
+	ctx, stop := cancelOnInterrupt()
+	defer stop()
+
+	results := g.SelfTest(ctx)
+	failed := 0
+	for _, r := range results {
+		if r.Passed() {
+			fmt.Printf("PASS %s\n", r.Name)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s: %s\n", r.Name, strings.Join(r.Failures, "; "))
+	}
+	fmt.Printf("%d of %d fixtures passed\n", len(results)-failed, len(results))
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// selfTest grades the fixtures of g, logging each failure, and returns an
+// error if any failed.
+func selfTest(g *grader.Grader) error {
+	results := g.SelfTest(context.Background())
+
+	var failed []string
+	for _, r := range results {
+		if r.Passed() {
+			continue
+		}
+		failed = append(failed, r.Name)
+		log.WithFields(log.Fields{
+			"fixture": r.Name,
+		}).Warnf("Self-test failed: %s", strings.Join(r.Failures, "; "))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d self-test fixtures failed: %s",
+			len(failed), len(results), strings.Join(failed, ", "))
+	}
+
+	log.Infof("All %d self-test fixtures passed", len(results))
+	return nil
+}
+
+func toFixtures(cfg []graderconfig.FixtureConfig, graderRoot string) ([]grader.Fixture, error) {
+	fixtures := make([]grader.Fixture, len(cfg))
+	for i, c := range cfg {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("fixture-%d", i)
+		}
+
+		// The config is validated, so exactly one of job and job_file is
+		// set.
+		var jobData []byte
+		var err error
+		if c.Job != nil {
+			jobData, err = json.Marshal(jsonValue(c.Job))
+			if err != nil {
+				return nil, fmt.Errorf("grader.selftest[%d].job: %v", i, err)
+			}
+		} else {
+			path := c.JobFile
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(graderRoot, path)
+			}
+			if jobData, err = ioutil.ReadFile(path); err != nil {
+				return nil, fmt.Errorf("grader.selftest[%d].job_file: %v", i, err)
+			}
+		}
+
+		fixtures[i] = grader.Fixture{
+			Name:     name,
+			JobData:  jobData,
+			Status:   grader.Status(c.Status),
+			MinScore: c.MinScore,
+			MaxScore: c.MaxScore,
+		}
+	}
+	return fixtures, nil
+}
+
+// jsonValue converts a value decoded from YAML, whose maps have interface{}
+// keys, into one which can be encoded as JSON.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = jsonValue(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[key] = jsonValue(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = jsonValue(val)
+		}
+		return s
+	}
+	return v
+}
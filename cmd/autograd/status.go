@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/PrairieLearn/autograd/grader"
+	"github.com/PrairieLearn/autograd/metrics"
+)
+
+// agentStatus is the state of the autograd process, as reported by the
+// status server.
+type agentStatus struct {
+	mu          sync.Mutex
+	started     time.Time
+	repoSynced  bool
+	initialized bool
+	initFailed  []string // init commands which failed
+	consuming   bool
+	commit      string
+}
+
+type jobStatus struct {
+	grader.JobStatus
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+type statusResponse struct {
+	Ready         bool        `json:"ready"`
+	NotReady      []string    `json:"not_ready,omitempty"`
+	UptimeSeconds float64     `json:"uptime_seconds"`
+	GraderCommit  string      `json:"grader_commit"`
+	Jobs          []jobStatus `json:"jobs"`
+}
+
+func newAgentStatus() *agentStatus {
+	return &agentStatus{
+		started: time.Now(),
+	}
+}
+
+// setLoaded records that the grader repo is checked out at commit and its
+// init commands have run, with the commands in initFailed failing.
+func (s *agentStatus) setLoaded(commit string, initFailed []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.repoSynced = true
+	s.initialized = true
+	s.initFailed = initFailed
+	s.commit = commit
+
+	graderCommit.Reset()
+	graderCommit.Set(1, commit)
+}
+
+func (s *agentStatus) setRepoSynced() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.repoSynced = true
+}
+
+func (s *agentStatus) setConsuming(consuming bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.consuming = consuming
+}
+
+// notReady returns the reasons the process is not ready to grade jobs.
+func (s *agentStatus) notReady() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reasons []string
+	if !s.repoSynced {
+		reasons = append(reasons, "grader repo not synced")
+	}
+	if !s.initialized {
+		reasons = append(reasons, "init commands not run")
+	} else if len(s.initFailed) > 0 {
+		reasons = append(reasons, "init commands failed: "+strings.Join(s.initFailed, ", "))
+	}
+	if !s.consuming {
+		reasons = append(reasons, "AMQP consumer not active")
+	}
+	return reasons
+}
+
+func (s *agentStatus) response() statusResponse {
+	notReady := s.notReady()
+
+	s.mu.Lock()
+	resp := statusResponse{
+		Ready:         len(notReady) == 0,
+		NotReady:      notReady,
+		UptimeSeconds: time.Since(s.started).Seconds(),
+		GraderCommit:  s.commit,
+		Jobs:          []jobStatus{},
+	}
+	s.mu.Unlock()
+
+	for _, job := range grader.RunningJobs() {
+		resp.Jobs = append(resp.Jobs, jobStatus{
+			JobStatus:      job,
+			ElapsedSeconds: time.Since(job.Started).Seconds(),
+		})
+	}
+	return resp
+}
+
+// serveStatus serves the health, readiness, metrics and status endpoints on
+// addr.
+func serveStatus(addr string, s *agentStatus) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if reasons := s.notReady(); len(reasons) > 0 {
+			http.Error(w, strings.Join(reasons, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.response()); err != nil {
+			log.Warnf("Error writing status: %s", err)
+		}
+	})
+
+	log.Infof("Serving status on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Status server failed: %s", err)
+	}
+}
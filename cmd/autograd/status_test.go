@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNotReady(t *testing.T) {
+	s := newAgentStatus()
+	want := []string{"grader repo not synced", "init commands not run", "AMQP consumer not active"}
+	if got := s.notReady(); !reflect.DeepEqual(got, want) {
+		t.Errorf("at startup got %q, want %q", got, want)
+	}
+
+	s.setLoaded("abc123", []string{"init[0]", "init[2]"})
+	s.setConsuming(true)
+	want = []string{"init commands failed: init[0], init[2]"}
+	if got := s.notReady(); !reflect.DeepEqual(got, want) {
+		t.Errorf("with failed init commands got %q, want %q", got, want)
+	}
+
+	s.setLoaded("def456", nil)
+	if got := s.notReady(); len(got) != 0 {
+		t.Errorf("once loaded got %q, want ready", got)
+	}
+}
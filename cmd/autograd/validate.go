@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/PrairieLearn/autograd/config"
+	graderconfig "github.com/PrairieLearn/autograd/grader/config"
+)
+
+// runValidateConfig implements "autograd validate-config": it checks an
+// autograd configuration file, with AUTOGRAD_* environment variable
+// overrides applied, and/or a grader repo's configuration file, and prints
+// every problem found. It returns the process exit code.
+func runValidateConfig(args []string) int {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	configPath := flags.String("config", "",
+		"autograd configuration file (default $AUTOGRAD_ROOT/_conf/configuration.yml if -grader-root is not set)")
+	graderRoot := flags.String("grader-root", "", "grader repo checkout whose configuration.yml to check")
+	checkFiles := flags.Bool("check-files", false,
+		"check that the files named by the autograd configuration, such as the SSH keys, can be read")
+	flags.Parse(args)
+
+	if *configPath == "" && *graderRoot == "" {
+		autogradRoot, err := config.GetAutogradRoot()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "autograd validate-config: %s; set -config or -grader-root\n", err)
+			return 2
+		}
+		*configPath = config.GetConfigPath(autogradRoot)
+	}
+
+	ok := true
+	if *configPath != "" {
+		overrides, err := config.EnvOverrides()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "autograd validate-config: %s\n", err)
+			return 1
+		}
+		if _, err := config.LoadFile(*configPath, overrides, *checkFiles); err != nil {
+			fmt.Println(err)
+			ok = false
+		} else {
+			fmt.Printf("%s: OK\n", *configPath)
+		}
+	}
+	if *graderRoot != "" {
+		if _, err := graderconfig.Load(*graderRoot); err != nil {
+			fmt.Println(err)
+			ok = false
+		} else {
+			fmt.Printf("%s: OK\n", *graderRoot)
+		}
+	}
+
+	if !ok {
+		return 1
+	}
+	return 0
+}
@@ -3,16 +3,21 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
-
-	"gopkg.in/yaml.v2"
 )
 
 const (
 	autogradRootEnvKey = "AUTOGRAD_ROOT"
 	configDir          = "_conf"
 	configFileName     = "configuration.yml"
+
+	// ShutdownFinish finishes the jobs in progress on SIGTERM.
+	ShutdownFinish = "finish"
+	// ShutdownRequeue aborts the jobs in progress on SIGTERM and requeues
+	// them.
+	ShutdownRequeue = "requeue"
 )
 
 func GetAutogradRoot() (string, error) {
@@ -23,17 +28,109 @@ func GetAutogradRoot() (string, error) {
 	return root, nil
 }
 
-func Load(autogradRoot string) (*Config, error) {
-	file, err := ioutil.ReadFile(filepath.Join(autogradRoot, configDir, configFileName))
-	if err != nil {
+// GetConfigPath returns the path of the autograd configuration file.
+func GetConfigPath(autogradRoot string) string {
+	return filepath.Join(autogradRoot, configDir, configFileName)
+}
+
+// Load loads the autograd configuration file from autogradRoot and applies
+// overrides to it, checking that the files it names can be read. See
+// LoadFile.
+func Load(autogradRoot string, overrides Overrides) (*Config, error) {
+	return LoadFile(GetConfigPath(autogradRoot), overrides, true)
+}
+
+// LoadFile loads an autograd configuration file, applies overrides to it and
+// validates the result. Unknown keys and invalid values are reported
+// together in a *ValidationError. With checkFiles, the files it names, such
+// as the SSH keys, must be readable; otherwise they only need to be set. The
+// file may be missing if there are overrides, so that autograd can be
+// configured entirely through them.
+func LoadFile(path string, overrides Overrides, checkFiles bool) (*Config, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil && !(os.IsNotExist(err) && len(overrides) > 0) {
 		return nil, err
 	}
 
 	var config Config
-	err = yaml.Unmarshal(file, &config)
+	problems, err := UnmarshalStrict(file, &config)
 	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	config.apply(overrides, problems)
+	config.validate(problems, checkFiles)
+	if err := problems.Err(path); err != nil {
 		return nil, err
 	}
 
 	return &config, nil
 }
+
+func (c *Config) validate(p *Problems, checkFiles bool) {
+	required(p, "amqp.url", c.AMQP.URL)
+	required(p, "amqp.grading_queue", c.AMQP.GradingQueue)
+	required(p, "amqp.started_queue", c.AMQP.StartedQueue)
+	required(p, "amqp.result_queue", c.AMQP.ResultQueue)
+	nonNegative(p, "amqp.workers", c.AMQP.Workers)
+	if c.AMQP.MaxRetries != nil {
+		nonNegative(p, "amqp.max_retries", *c.AMQP.MaxRetries)
+	}
+	nonNegative(p, "amqp.confirm_timeout", c.AMQP.ConfirmTimeout)
+	if c.AMQP.PublishRetries != nil {
+		nonNegative(p, "amqp.publish_retries", *c.AMQP.PublishRetries)
+	}
+	nonNegative(p, "amqp.reconnect_interval", c.AMQP.ReconnectInterval)
+	nonNegative(p, "amqp.max_reconnect_interval", c.AMQP.MaxReconnectInterval)
+	nonNegative(p, "amqp.max_reconnect_attempts", c.AMQP.MaxReconnectAttempts)
+	nonNegative(p, "amqp.shutdown_timeout", c.AMQP.ShutdownTimeout)
+	switch c.AMQP.ShutdownMode {
+	case "", ShutdownFinish, ShutdownRequeue:
+	default:
+		p.Addf("amqp.shutdown_mode", "must be %q or %q, not %q", ShutdownFinish, ShutdownRequeue,
+			c.AMQP.ShutdownMode)
+	}
+
+	required(p, "grader_repo.repo_url", c.GraderRepo.RepoURL)
+	required(p, "grader_repo.commit", c.GraderRepo.Commit)
+	readable(p, "grader_repo.credentials.public_key", c.GraderRepo.Credentials.PublicKey, checkFiles)
+	readable(p, "grader_repo.credentials.private_key", c.GraderRepo.Credentials.PrivateKey, checkFiles)
+	nonNegative(p, "grader_repo.poll_interval", c.GraderRepo.PollInterval)
+	nonNegative(p, "grader_repo.revision_cache_size", c.GraderRepo.RevisionCacheSize)
+
+	if c.HTTP.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.Listen); err != nil {
+			p.Addf("http.listen", "%v", err)
+		}
+	}
+}
+
+func required(p *Problems, path, value string) {
+	if value == "" {
+		p.Addf(path, "is required")
+	}
+}
+
+func nonNegative(p *Problems, path string, value int) {
+	if value < 0 {
+		p.Addf(path, "must not be negative, got %d", value)
+	}
+}
+
+// readable reports a problem if file is not set or, with checkFiles, cannot
+// be read.
+func readable(p *Problems, path, file string, checkFiles bool) {
+	if file == "" {
+		p.Addf(path, "is required")
+		return
+	}
+	if !checkFiles {
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		p.Addf(path, "%v", err)
+		return
+	}
+	f.Close()
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	envPrefix  = "AUTOGRAD_"
+	fileSuffix = "_file"
+)
+
+// Override sets the value of the configuration key Key (e.g.
+// "amqp.grading_queue"). Source says where the value came from, for error
+// messages.
+type Override struct {
+	Key    string
+	Value  string
+	Source string
+}
+
+// Overrides are applied in order, so later overrides take precedence.
+type Overrides []Override
+
+// Keys returns the key of every configuration value which can be
+// overridden.
+func Keys() []string {
+	fields := (&Config{}).fields()
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// EnvName returns the environment variable which overrides key, e.g.
+// AUTOGRAD_AMQP_GRADING_QUEUE for amqp.grading_queue.
+func EnvName(key string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// EnvOverrides returns the overrides set in the environment. The value of a
+// string key can also be read from a file named by the key's variable with
+// a _FILE suffix, e.g. AUTOGRAD_AMQP_URL_FILE, so that secrets can be
+// mounted as files. Trailing newlines are removed from values read from
+// files.
+func EnvOverrides() (Overrides, error) {
+	fields := (&Config{}).fields()
+
+	var overrides Overrides
+	for _, key := range Keys() {
+		name := EnvName(key)
+		value, isSet := os.LookupEnv(name)
+		if isSet {
+			overrides = append(overrides, Override{Key: key, Value: value, Source: name})
+		}
+
+		if kind(fields[key]) != reflect.String {
+			continue
+		}
+		fileName := name + strings.ToUpper(fileSuffix)
+		path, isFileSet := os.LookupEnv(fileName)
+		if !isFileSet {
+			continue
+		}
+		if isSet {
+			return nil, fmt.Errorf("Only one of %s and %s can be set", name, fileName)
+		}
+		value, err := readSecret(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+		overrides = append(overrides, Override{Key: key, Value: value, Source: fileName})
+	}
+	return overrides, nil
+}
+
+// ClearEnvOverrides removes the variables read by EnvOverrides from the
+// environment, so that they are not inherited by grader commands.
+func ClearEnvOverrides() {
+	for _, key := range Keys() {
+		os.Unsetenv(EnvName(key))
+		os.Unsetenv(EnvName(key) + strings.ToUpper(fileSuffix))
+	}
+}
+
+// RegisterFlags defines a flag for every configuration key on fs, named
+// after the key (e.g. -amqp.grading_queue), and a flag with a _file suffix
+// for every string key. The returned func returns the overrides set by the
+// flags once fs has been parsed.
+func RegisterFlags(fs *flag.FlagSet) func() (Overrides, error) {
+	fields := (&Config{}).fields()
+	for _, key := range Keys() {
+		fs.String(key, "", fmt.Sprintf("overrides %s (also %s)", key, EnvName(key)))
+		if kind(fields[key]) == reflect.String {
+			fs.String(key+fileSuffix, "", fmt.Sprintf("file to read %s from", key))
+		}
+	}
+
+	return func() (Overrides, error) {
+		var overrides Overrides
+		var err error
+		fs.Visit(func(f *flag.Flag) {
+			if err != nil {
+				return
+			}
+			source := "-" + f.Name
+			if _, isKey := fields[f.Name]; isKey {
+				overrides = append(overrides, Override{Key: f.Name, Value: f.Value.String(), Source: source})
+				return
+			}
+
+			key := strings.TrimSuffix(f.Name, fileSuffix)
+			if isFlagSet(fs, key) {
+				err = fmt.Errorf("Only one of -%s and %s can be set", key, source)
+				return
+			}
+			value, rerr := readSecret(f.Value.String())
+			if rerr != nil {
+				err = fmt.Errorf("%s: %v", source, rerr)
+				return
+			}
+			overrides = append(overrides, Override{Key: key, Value: value, Source: source})
+		})
+		return overrides, err
+	}
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+func readSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// apply sets the overridden values, recording values which cannot be parsed
+// as problems.
+func (c *Config) apply(overrides Overrides, p *Problems) {
+	fields := c.fields()
+	for _, o := range overrides {
+		p.sources[o.Key] = o.Source
+
+		field, ok := fields[o.Key]
+		if !ok {
+			p.Addf(o.Key, "unknown key")
+			continue
+		}
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(o.Value)
+		case reflect.Int:
+			v, err := strconv.Atoi(o.Value)
+			if err != nil {
+				p.Addf(o.Key, "must be an integer, got %q", o.Value)
+				continue
+			}
+			field.SetInt(int64(v))
+		case reflect.Bool:
+			v, err := strconv.ParseBool(o.Value)
+			if err != nil {
+				p.Addf(o.Key, "must be true or false, got %q", o.Value)
+				continue
+			}
+			field.SetBool(v)
+		}
+	}
+}
+
+// fields returns the string, int and bool fields of c, and pointers to them,
+// by key.
+func (c *Config) fields() map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	collectFields(reflect.ValueOf(c).Elem(), "", fields)
+	return fields
+}
+
+func collectFields(v reflect.Value, path string, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		field := v.Field(i)
+		switch kind(field) {
+		case reflect.Struct:
+			collectFields(field, joinPath(path, key), fields)
+		case reflect.String, reflect.Int, reflect.Bool:
+			fields[joinPath(path, key)] = field
+		}
+	}
+}
+
+// kind returns the kind of v, or of what v points to if it is a pointer.
+func kind(v reflect.Value) reflect.Kind {
+	t := v.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind()
+}
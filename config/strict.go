@@ -0,0 +1,246 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ValidationError lists every problem found in a configuration file, each
+// prefixed with its line number when it is known.
+type ValidationError struct {
+	File     string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %d problem(s):\n  %s", e.File, len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// Problems collects validation problems for a configuration file. Problems
+// are reported by key path, e.g. "amqp.grading_queue", which is used to look
+// up the line the key is on.
+type Problems struct {
+	lines    lineIndex
+	sources  map[string]string // overridden keys, by path
+	problems []string
+}
+
+// Addf records a problem with the key at path.
+func (p *Problems) Addf(path, format string, args ...interface{}) {
+	msg := path + ": " + fmt.Sprintf(format, args...)
+	if source, ok := p.sources[path]; ok {
+		msg = fmt.Sprintf("%s (set by %s)", msg, source)
+	} else if line, ok := p.lines.line(path); ok {
+		msg = fmt.Sprintf("line %d: %s", line, msg)
+	}
+	p.problems = append(p.problems, msg)
+}
+
+// Err returns a *ValidationError for file if any problems were recorded.
+func (p *Problems) Err(file string) error {
+	if len(p.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{File: file, Problems: p.problems}
+}
+
+// UnmarshalStrict decodes YAML into out like yaml.Unmarshal, but also
+// reports keys which do not match any field of out. Decoding continues past
+// problems so they can all be reported at once; the caller adds its own
+// checks to the returned Problems.
+func UnmarshalStrict(in []byte, out interface{}) (*Problems, error) {
+	p := &Problems{
+		lines:   newLineIndex(in),
+		sources: make(map[string]string),
+	}
+
+	if err := yaml.Unmarshal(in, out); err != nil {
+		terr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return nil, err
+		}
+		p.problems = append(p.problems, terr.Errors...)
+	}
+
+	var raw interface{}
+	if err := yaml.Unmarshal(in, &raw); err != nil {
+		return nil, err
+	}
+	p.checkKeys(raw, reflect.TypeOf(out), "")
+
+	return p, nil
+}
+
+// checkKeys reports the keys of maps in v with no matching field in t.
+func (p *Problems) checkKeys(v interface{}, t reflect.Type, path string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			// e.g. a command written as a plain argv list
+			return
+		}
+		fields := yamlFields(t)
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, fmt.Sprint(key))
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field, ok := fields[key]
+			if !ok {
+				p.Addf(joinPath(path, key), "unknown key")
+				continue
+			}
+			p.checkKeys(m[key], field, joinPath(path, key))
+		}
+	case reflect.Slice:
+		if s, ok := v.([]interface{}); ok {
+			for i, elem := range s {
+				p.checkKeys(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case reflect.Map:
+		if m, ok := v.(map[interface{}]interface{}); ok {
+			for key, elem := range m {
+				p.checkKeys(elem, t.Elem(), joinPath(path, fmt.Sprint(key)))
+			}
+		}
+	}
+}
+
+// yamlFields returns the type of each field of struct t by YAML key,
+// including the fields of inlined structs.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		inline := false
+		for _, flag := range parts[1:] {
+			inline = inline || flag == "inline"
+		}
+		if inline {
+			for key, ft := range yamlFields(f.Type) {
+				fields[key] = ft
+			}
+			continue
+		}
+
+		key := parts[0]
+		if key == "" {
+			key = strings.ToLower(f.Name)
+		}
+		fields[key] = f.Type
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// lineIndex maps key paths to the lines they appear on. It understands the
+// block style YAML used in configuration files; keys in flow style maps are
+// not indexed. List items are part of paths as their index, e.g.
+// "grader.selftest[1].min_score", and a list item's own path refers to the
+// line it starts on.
+type lineIndex map[string]int
+
+var (
+	itemLineRe = regexp.MustCompile(`^(\s*)-(\s+|$)`)
+	keyLineRe  = regexp.MustCompile(`^(\s*)([A-Za-z0-9_]+)\s*:(\s|$)`)
+)
+
+func newLineIndex(in []byte) lineIndex {
+	idx := make(lineIndex)
+
+	// stack holds the keys and list items enclosing the current line.
+	type entry struct {
+		indent int
+		path   string
+		item   bool
+	}
+	var stack []entry
+	items := make(map[string]int) // number of items seen in each list
+	parent := func() string {
+		if len(stack) == 0 {
+			return ""
+		}
+		return stack[len(stack)-1].path
+	}
+
+	for n, line := range strings.Split(string(in), "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// A line may start any number of nested list items before its key.
+		offset := 0
+		for {
+			m := itemLineRe.FindStringSubmatch(line[offset:])
+			if m == nil {
+				break
+			}
+			indent := offset + len(m[1])
+			for len(stack) > 0 {
+				top := stack[len(stack)-1]
+				// A key at the same indent as its list's items is
+				// the list's parent in compact style YAML.
+				if top.indent > indent || (top.indent == indent && top.item) {
+					stack = stack[:len(stack)-1]
+					continue
+				}
+				break
+			}
+			list := parent()
+			path := fmt.Sprintf("%s[%d]", list, items[list])
+			items[list]++
+			stack = append(stack, entry{indent: indent, path: path, item: true})
+			idx[path] = n + 1
+
+			offset += len(m[0])
+		}
+
+		m := keyLineRe.FindStringSubmatch(line[offset:])
+		if m == nil {
+			continue
+		}
+		indent := offset + len(m[1])
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		path := joinPath(parent(), m[2])
+		stack = append(stack, entry{indent: indent, path: path})
+		if _, ok := idx[path]; !ok {
+			idx[path] = n + 1
+		}
+	}
+	return idx
+}
+
+// line returns the line path appears on.
+func (idx lineIndex) line(path string) (int, bool) {
+	n, ok := idx[path]
+	return n, ok
+}
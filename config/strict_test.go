@@ -0,0 +1,98 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineIndex(t *testing.T) {
+	in := `# comment
+grader:
+  init_commands:
+    - ["make"]
+    - command: ["make", "install"]
+      on_failure: retry 2
+  selftest:
+  - name: passes
+    min_score: 1
+
+  - name: fails
+    job:
+      gid: g1
+    min_score: 5
+  grade_timeout: 30
+matrix:
+  - - a
+    - b: 1
+`
+	tests := []struct {
+		path string
+		line int
+	}{
+		{"grader", 2},
+		{"grader.init_commands", 3},
+		{"grader.init_commands[0]", 4},
+		{"grader.init_commands[1]", 5},
+		{"grader.init_commands[1].command", 5},
+		{"grader.init_commands[1].on_failure", 6},
+		{"grader.selftest[0]", 8},
+		{"grader.selftest[0].min_score", 9},
+		{"grader.selftest[1].name", 11},
+		{"grader.selftest[1].job.gid", 13},
+		{"grader.selftest[1].min_score", 14},
+		{"grader.grade_timeout", 15},
+		{"matrix[0][0]", 17},
+		{"matrix[0][1].b", 18},
+	}
+
+	idx := newLineIndex([]byte(in))
+	for _, tt := range tests {
+		line, ok := idx.line(tt.path)
+		if !ok || line != tt.line {
+			t.Errorf("line(%q) = %d, %v, want %d", tt.path, line, ok, tt.line)
+		}
+	}
+	for _, path := range []string{"grader.selftest.min_score", "grader.selftest[2]", "name"} {
+		if line, ok := idx.line(path); ok {
+			t.Errorf("line(%q) = %d, want not found", path, line)
+		}
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	in := `amqp:
+  url: amqp://localhost/
+  workers: many
+  grading_queu: grade
+grader_repo:
+  credentials:
+    passphrse: secret
+unknown_section:
+  key: value
+`
+	var c Config
+	p, err := UnmarshalStrict([]byte(in), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"line 3: cannot unmarshal !!str `many` into int",
+		"line 4: amqp.grading_queu: unknown key",
+		"line 7: grader_repo.credentials.passphrse: unknown key",
+		"line 8: unknown_section: unknown key",
+	}
+	if !reflect.DeepEqual(p.problems, want) {
+		t.Errorf("got problems\n  %q\nwant\n  %q", p.problems, want)
+	}
+	if c.AMQP.URL != "amqp://localhost/" {
+		t.Errorf("got amqp.url %q, want decoding to continue past problems", c.AMQP.URL)
+	}
+}
+
+func TestUnmarshalStrictSyntaxError(t *testing.T) {
+	var c Config
+	if _, err := UnmarshalStrict([]byte("amqp: [unclosed"), &c); err == nil {
+		t.Error("got no error for invalid YAML")
+	}
+}
@@ -3,19 +3,33 @@ package config
 type Config struct {
 	AMQP       AMQPConfig       `yaml:"amqp"`
 	GraderRepo GraderRepoConfig `yaml:"grader_repo"`
+	HTTP       HTTPConfig       `yaml:"http"`
 }
 
 type AMQPConfig struct {
-	URL          string `yaml:"url"`
-	GradingQueue string `yaml:"grading_queue"`
-	StartedQueue string `yaml:"started_queue"`
-	ResultQueue  string `yaml:"result_queue"`
+	URL                  string `yaml:"url"`
+	GradingQueue         string `yaml:"grading_queue"`
+	StartedQueue         string `yaml:"started_queue"`
+	ResultQueue          string `yaml:"result_queue"`
+	Workers              int    `yaml:"workers"`
+	MaxRetries           *int   `yaml:"max_retries"` // nil means the default
+	DeadLetterQueue      string `yaml:"dead_letter_queue"`
+	ConfirmTimeout       int    `yaml:"confirm_timeout"`
+	PublishRetries       *int   `yaml:"publish_retries"` // nil means the default
+	ShutdownMode         string `yaml:"shutdown_mode"`
+	ShutdownTimeout      int    `yaml:"shutdown_timeout"`
+	ReconnectInterval    int    `yaml:"reconnect_interval"`
+	MaxReconnectInterval int    `yaml:"max_reconnect_interval"`
+	MaxReconnectAttempts int    `yaml:"max_reconnect_attempts"`
 }
 
 type GraderRepoConfig struct {
-	RepoURL     string     `yaml:"repo_url"`
-	Commit      string     `yaml:"commit"`
-	Credentials CredConfig `yaml:"credentials"`
+	RepoURL           string     `yaml:"repo_url"`
+	Commit            string     `yaml:"commit"`
+	Credentials       CredConfig `yaml:"credentials"`
+	PollInterval      int        `yaml:"poll_interval"`
+	RevisionCacheSize int        `yaml:"revision_cache_size"`
+	RequireSelfTest   bool       `yaml:"require_selftest"`
 }
 
 type CredConfig struct {
@@ -23,3 +37,7 @@ type CredConfig struct {
 	PrivateKey string `yaml:"private_key"`
 	Passphrase string `yaml:"passphrase"`
 }
+
+type HTTPConfig struct {
+	Listen string `yaml:"listen"`
+}
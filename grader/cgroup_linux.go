@@ -0,0 +1,239 @@
+//go:build linux
+// +build linux
+
+package grader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	cgroupPrefix = "cmd_"
+	cgroupLeaf   = "agent"
+
+	// cgroupRemoveTimeout is how long removeCgroup waits for the processes
+	// of a cgroup to exit after killing them.
+	cgroupRemoveTimeout = 5 * time.Second
+)
+
+// cgroupControllers are enabled for the cgroup of each command.
+var cgroupControllers = []string{"memory", "pids"}
+
+// cgroupBase is the cgroup v2 directory under which a cgroup is created for
+// each command with memory or processes limits, or "" if cgroups are not
+// available. It is set up on first use.
+var (
+	cgroupOnce sync.Once
+	cgroupBase string
+)
+
+// cgroupsAvailable returns whether memory and processes limits can be
+// enforced with cgroups.
+func cgroupsAvailable() bool {
+	cgroupOnce.Do(func() {
+		base, err := setupCgroups()
+		if err != nil {
+			log.Infof("cgroup v2 not available for resource limits: %v", err)
+			return
+		}
+		cgroupBase = base
+	})
+	return cgroupBase != ""
+}
+
+// setupCgroups prepares the process's own cgroup v2 cgroup to hold a cgroup
+// for each command. A cgroup whose children use controllers cannot hold
+// processes itself, so the process first moves into a leaf cgroup.
+func setupCgroups() (string, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	path, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Join(mount, path)
+
+	available, err := ioutil.ReadFile(filepath.Join(base, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	for _, controller := range cgroupControllers {
+		if !containsString(strings.Fields(string(available)), controller) {
+			return "", fmt.Errorf("%s controller not available in %s", controller, base)
+		}
+	}
+
+	// Cgroups left over from a previous run are empty once their processes
+	// are gone.
+	leftover, _ := filepath.Glob(filepath.Join(base, cgroupPrefix+"*"))
+	for _, dir := range leftover {
+		removeCgroup(dir)
+	}
+
+	leaf := filepath.Join(base, cgroupLeaf)
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if err := writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return "", err
+	}
+	enable := "+" + strings.Join(cgroupControllers, " +")
+	if err := writeCgroupFile(base, "cgroup.subtree_control", enable); err != nil {
+		return "", err
+	}
+	return base, nil
+}
+
+// cgroup2Mount returns where the cgroup v2 hierarchy is mounted.
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 42 32 0:38 / /sys/fs/cgroup rw,relatime - cgroup2 cgroup2 rw
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("cgroup2 is not mounted")
+}
+
+// ownCgroup returns the process's cgroup v2 path.
+func ownCgroup() (string, error) {
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", errors.New("process is not in a cgroup v2 cgroup")
+}
+
+// newCgroup creates a cgroup enforcing the memory and processes limits in
+// limits.
+func newCgroup(limits *Limits) (string, error) {
+	dir, err := ioutil.TempDir(cgroupBase, cgroupPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	if limits.Memory > 0 {
+		err = writeCgroupFile(dir, "memory.max", strconv.FormatInt(limits.Memory, 10))
+		if err == nil {
+			// Swapping would let the command go past memory.max.
+			if err := writeCgroupFile(dir, "memory.swap.max", "0"); err != nil && !os.IsNotExist(err) {
+				log.Warnf("Error disabling swap for cgroup: %v", err)
+			}
+		}
+	}
+	if err == nil && limits.Processes > 0 {
+		err = writeCgroupFile(dir, "pids.max", strconv.FormatInt(limits.Processes, 10))
+	}
+	if err != nil {
+		removeCgroup(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// joinCgroup moves the current process into the cgroup at dir.
+func joinCgroup(dir string) error {
+	return writeCgroupFile(dir, "cgroup.procs", "0")
+}
+
+// cgroupViolation returns a limitError if a process in the cgroup at dir was
+// killed for running out of memory or failed to start for exceeding the
+// processes limit.
+func cgroupViolation(dir string) error {
+	if readCgroupEvent(dir, "memory.events", "oom_kill") > 0 {
+		return &limitError{resource: "memory"}
+	}
+	if readCgroupEvent(dir, "pids.events", "max") > 0 {
+		return &limitError{resource: "processes"}
+	}
+	return nil
+}
+
+// removeCgroup kills whatever is left running in the cgroup at dir and
+// removes it.
+func removeCgroup(dir string) {
+	if err := writeCgroupFile(dir, "cgroup.kill", "1"); err != nil {
+		// cgroup.kill is new in Linux 5.14.
+		procs, _ := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+		for _, pid := range strings.Fields(string(procs)) {
+			if pid, err := strconv.Atoi(pid); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(cgroupRemoveTimeout)
+	for {
+		err := syscall.Rmdir(dir)
+		if err == nil || err == syscall.ENOENT {
+			return
+		}
+		if err != syscall.EBUSY || time.Now().After(deadline) {
+			log.Warnf("Error removing cgroup %s: %v", dir, err)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+// readCgroupEvent returns the count of key in a cgroup events file, or 0 if
+// it cannot be read.
+func readCgroupEvent(dir, name, key string) int64 {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
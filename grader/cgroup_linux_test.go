@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package grader
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCgroupOnlySpecIsNotEmpty(t *testing.T) {
+	spec := (&execSpec{Limits: &Limits{Processes: 64}}).withCgroup("/sys/fs/cgroup/cmd_1")
+	if spec.empty() {
+		t.Error("got an empty spec for a command which has to join its cgroup")
+	}
+}
+
+func TestUnsandboxedCommandJoinsCgroup(t *testing.T) {
+	if !cgroupsAvailable() {
+		t.Skip("cgroup v2 not available")
+	}
+
+	var out bytes.Buffer
+	spec := &execSpec{Limits: &Limits{Processes: 64}}
+	if _, err := execWithTimeout(context.Background(), []string{"cat", "/proc/self/cgroup"}, os.TempDir(), nil,
+		5*time.Second, 0, spec, &out, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "/"+cgroupPrefix) {
+		t.Errorf("got cgroups %q, want the command in its own cgroup", out.String())
+	}
+}
+
+func TestCgroupViolation(t *testing.T) {
+	tests := []struct {
+		name   string
+		memory string
+		pids   string
+		want   string
+	}{
+		{name: "no events files", want: ""},
+		{
+			name:   "no violation",
+			memory: "low 0\nhigh 0\nmax 3\noom 0\noom_kill 0\n",
+			pids:   "max 0\n",
+			want:   "",
+		},
+		{name: "oom kill", memory: "low 0\nhigh 0\nmax 12\noom 1\noom_kill 1\n", pids: "max 0\n", want: "memory"},
+		{name: "processes", memory: "oom_kill 0\n", pids: "max 5\n", want: "processes"},
+	}
+
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "cgroup_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if tt.memory != "" {
+			if err := ioutil.WriteFile(filepath.Join(dir, "memory.events"), []byte(tt.memory), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.pids != "" {
+			if err := ioutil.WriteFile(filepath.Join(dir, "pids.events"), []byte(tt.pids), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = cgroupViolation(dir)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: got %v, want no violation", tt.name, err)
+			}
+			continue
+		}
+		if lerr, ok := err.(*limitError); !ok || lerr.resource != tt.want {
+			t.Errorf("%s: got %v, want %s limit exceeded", tt.name, err, tt.want)
+		}
+	}
+}
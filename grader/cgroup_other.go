@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package grader
+
+import "errors"
+
+func cgroupsAvailable() bool {
+	return false
+}
+
+func newCgroup(limits *Limits) (string, error) {
+	return "", errors.New("cgroups are only supported on Linux")
+}
+
+func cgroupViolation(dir string) error {
+	return nil
+}
+
+func removeCgroup(dir string) {}
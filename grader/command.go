@@ -1,12 +1,13 @@
 package grader
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -14,7 +15,48 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
-func RunCommands(commands [][]string, jobDir string, env map[string]string, gid string, stage Stage) {
+// FailurePolicy says what a stage does when one of its commands fails.
+type FailurePolicy string
+
+const (
+	// FailureAbort stops running commands and fails the stage.
+	FailureAbort FailurePolicy = "abort"
+	// FailureContinue logs the failure and runs the next command.
+	FailureContinue FailurePolicy = "continue"
+	// FailureRetry runs the command again up to Command.Retries times,
+	// then fails the stage.
+	FailureRetry FailurePolicy = "retry"
+)
+
+const (
+	// defaultCommandTimeout is the timeout for init, setup and cleanup
+	// commands which do not set one.
+	defaultCommandTimeout = 30 * time.Minute
+
+	// DefaultKillGracePeriod is how long a command has to exit after
+	// SIGTERM before it is sent SIGKILL.
+	DefaultKillGracePeriod = 10 * time.Second
+)
+
+// Command is an init, setup or cleanup command. A command fails if it cannot
+// be run, times out or exits non-zero.
+type Command struct {
+	Argv      []string
+	OnFailure FailurePolicy // defaults to FailureContinue if empty
+	Retries   int
+	Timeout   time.Duration     // defaults to defaultCommandTimeout if zero
+	Env       map[string]string // added to the stage's environment
+	Dir       string            // relative to the stage's working directory
+}
+
+// runCommands runs commands one after another, confined as described by
+// spec. It returns the names of the commands which failed but whose failure
+// policy let the rest run, and an error if a command failed and its failure
+// policy did not, or if ctx was canceled. Commands which time out
+// or are canceled get the kill grace period to exit after SIGTERM. The kept
+// output of each command is written to the output log.
+func (g *Grader) runCommands(ctx context.Context, commands []Command, jobDir string, env map[string]string,
+	gid string, stage Stage, spec *execSpec) (failed []string, err error) {
 	fields := make(log.Fields)
 	if gid != "" {
 		fields["gid"] = gid
@@ -22,19 +64,119 @@ func RunCommands(commands [][]string, jobDir string, env map[string]string, gid
 
 	log.WithFields(fields).Infof("Running %s commands", stage)
 
-	for i, argv := range commands {
-		fields["command"] = fmt.Sprintf("%s[%d]", stage, i)
-		log.WithFields(fields).Info(strings.Join(argv, " "))
-		_, _, err := execWithTimeout(argv, jobDir, env, 30*time.Minute)
-		if err != nil {
+	for i, command := range commands {
+		name := fmt.Sprintf("%s[%d]", stage, i)
+		fields["command"] = name
+
+		policy := command.OnFailure
+		if policy == "" {
+			policy = FailureContinue
+		}
+		attempts := 1
+		if policy == FailureRetry {
+			attempts += command.Retries
+		}
+
+		var out *cappedBuffer
+		for attempt := 1; attempt <= attempts; attempt++ {
+			if attempt > 1 {
+				log.WithFields(fields).Warnf("Retrying (attempt %d of %d)", attempt, attempts)
+			}
+			log.WithFields(fields).Info(strings.Join(command.Argv, " "))
+			out = newCappedBuffer(g.output.limit(stage), spillName(gid, name))
+			err = command.run(ctx, jobDir, env, spec, g.killGrace, out)
+			logOutput(g.output, log.Fields{"gid": gid, "command": name}, out)
+			if err == nil {
+				break
+			}
 			log.WithFields(fields).Warn(err)
+			if _, ok := err.(*timeoutError); ok {
+				g.recorder.inc(commandTimeouts, string(stage))
+			}
+			if ctx.Err() != nil {
+				return failed, ctx.Err()
+			}
 		}
+		if err != nil {
+			if policy != FailureContinue {
+				return failed, &stageError{command: name, err: err, output: out.Bytes()}
+			}
+			failed = append(failed, name)
+		}
+	}
+	return failed, nil
+}
+
+// stageError is returned by runCommands when a command failed and its
+// failure policy stopped the stage.
+type stageError struct {
+	command string
+	err     error
+	output  []byte // kept output of the command's last attempt
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.command, e.err)
+}
+
+func (c *Command) run(ctx context.Context, dir string, env map[string]string, spec *execSpec,
+	grace time.Duration, output io.Writer) error {
+	if len(c.Env) > 0 {
+		commandEnv := make(map[string]string, len(env)+len(c.Env))
+		for key, val := range env {
+			commandEnv[key] = val
+		}
+		for key, val := range c.Env {
+			commandEnv[key] = expandArgs([]string{val}, env)[0]
+		}
+		env = commandEnv
+	}
+
+	if c.Dir != "" {
+		commandDir := expandArgs([]string{c.Dir}, env)[0]
+		if !filepath.IsAbs(commandDir) {
+			commandDir = filepath.Join(dir, commandDir)
+		}
+		dir = commandDir
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
 	}
+
+	exitCode, err := execWithTimeout(ctx, c.Argv, dir, env, timeout, grace, spec, output, output)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("Command exited with status %d", exitCode)
+	}
+	return nil
+}
+
+// timeoutError is returned by execWithTimeout when the command ran past its
+// timeout and was killed.
+type timeoutError struct {
+	timeout time.Duration
+	killErr error
 }
 
-func execWithTimeout(argv []string, dir string, env map[string]string, timeout time.Duration) (*bytes.Buffer, int, error) {
+func (e *timeoutError) Error() string {
+	if e.killErr != nil {
+		return fmt.Sprintf("Command timed out (%s), failed to kill process: %v", e.timeout.String(), e.killErr)
+	}
+	return fmt.Sprintf("Command timed out (%s), process killed", e.timeout.String())
+}
+
+// execWithTimeout runs a command, confined as described by spec, copying its
+// output to stdout and stderr. If the command runs past timeout or ctx is
+// canceled, its process group is sent SIGTERM, then SIGKILL if it has not
+// exited after grace.
+func execWithTimeout(ctx context.Context, argv []string, dir string, env map[string]string,
+	timeout, grace time.Duration, spec *execSpec, stdout, stderr io.Writer) (int, error) {
 	if len(argv) == 0 {
-		return nil, 0, errors.New("Empty command")
+		return 0, errors.New("Empty command")
 	}
 
 	expandedArgv := expandArgs(argv, env)
@@ -43,35 +185,99 @@ func execWithTimeout(argv []string, dir string, env map[string]string, timeout t
 	cmd.Dir = dir
 	cmd.Env = buildEnvSlice(env)
 
-	var out bytes.Buffer
-	cmd.Stdout = io.MultiWriter(os.Stdout, &out)
-	cmd.Stderr = io.MultiWriter(os.Stdout, &out)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
+	if limits := spec.limits(); limits != nil && (limits.Memory > 0 || limits.Processes > 0) && cgroupsAvailable() {
+		cgroup, err := newCgroup(limits)
+		if err != nil {
+			return 0, fmt.Errorf("Creating cgroup: %v", err)
+		}
+		defer removeCgroup(cgroup)
+		spec = spec.withCgroup(cgroup)
+	}
+
+	var proc *execProcess
+	if !spec.empty() {
+		var err error
+		if cmd, proc, err = spec.wrap(cmd, expandedArgv); err != nil {
+			return 0, err
+		}
+	}
+
 	if err := cmd.Start(); err != nil {
-		return &out, 0, err
+		if proc != nil {
+			proc.close()
+		}
+		return 0, err
+	}
+	if proc != nil {
+		proc.started()
 	}
-	done := make(chan error)
+	done := make(chan error, 1)
 	go func() { done <- cmd.Wait() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	select {
 	case err := <-done:
-		if err != nil {
-			if exiterr, ok := err.(*exec.ExitError); ok {
-				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-					return &out, status.ExitStatus(), nil
-				}
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			return 0, err
+		}
+		status, _ := cmd.ProcessState.Sys().(syscall.WaitStatus)
+		rusage, _ := cmd.ProcessState.SysUsage().(*syscall.Rusage)
+		if proc != nil {
+			if status, rusage, err = proc.exitStatus(status, rusage); err != nil {
+				return 0, err
 			}
-			return &out, 0, err
 		}
-		return &out, 0, nil
-	case <-time.After(timeout):
-		if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
-			return &out, 0, fmt.Errorf("Command timed out (%s), failed to kill process: %v",
-				timeout.String(), err)
+		if spec != nil && spec.Cgroup != "" {
+			if err := cgroupViolation(spec.Cgroup); err != nil {
+				return 0, err
+			}
+		}
+		if err := spec.limits().violation(status, rusage); err != nil {
+			return 0, err
+		}
+		if status.Signaled() {
+			return 0, fmt.Errorf("Command killed by signal: %s", status.Signal())
+		}
+		return status.ExitStatus(), nil
+	case <-timer.C:
+		err := stopProcessGroup(cmd.Process.Pid, done, grace)
+		if proc != nil {
+			proc.close()
+		}
+		return 0, &timeoutError{timeout: timeout, killErr: err}
+	case <-ctx.Done():
+		err := stopProcessGroup(cmd.Process.Pid, done, grace)
+		if proc != nil {
+			proc.close()
 		}
-		return &out, 0, fmt.Errorf("Command timed out (%s), process killed", timeout.String())
+		if err != nil {
+			return 0, fmt.Errorf("Command canceled, failed to kill process: %v", err)
+		}
+		return 0, ctx.Err()
+	}
+}
+
+// stopProcessGroup sends SIGTERM to the process group led by pid, giving it
+// grace to exit before sending SIGKILL to whatever is left of the group.
+func stopProcessGroup(pid int, done <-chan error, grace time.Duration) error {
+	if grace > 0 && syscall.Kill(-pid, syscall.SIGTERM) == nil {
+		select {
+		case <-done:
+		case <-time.After(grace):
+		}
+	}
+
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
 	}
+	return nil
 }
 
 func expandArgs(argv []string, env map[string]string) []string {
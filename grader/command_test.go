@@ -0,0 +1,137 @@
+package grader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestGrader returns a Grader with a temporary autograd root, which writes
+// nothing to the output log.
+func newTestGrader(t *testing.T, setup []Command, gradeCommand []string) *Grader {
+	root, err := ioutil.TempDir("", "grader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	g := New(root, root, setup, gradeCommand, nil, 10)
+	g.SetOutputLog(ioutil.Discard)
+	return g
+}
+
+func TestRunCommandsFailurePolicy(t *testing.T) {
+	fail := []string{"sh", "-c", "echo attempt >> attempts; exit 1"}
+	next := []string{"sh", "-c", "echo next > next"}
+
+	tests := []struct {
+		name     string
+		command  Command
+		attempts int
+		next     bool
+		failed   []string
+		err      bool
+	}{
+		{name: "default", command: Command{Argv: fail}, attempts: 1, next: true, failed: []string{"setup[0]"}},
+		{
+			name:     "continue",
+			command:  Command{Argv: fail, OnFailure: FailureContinue},
+			attempts: 1,
+			next:     true,
+			failed:   []string{"setup[0]"},
+		},
+		{name: "abort", command: Command{Argv: fail, OnFailure: FailureAbort}, attempts: 1, err: true},
+		{name: "retry", command: Command{Argv: fail, OnFailure: FailureRetry, Retries: 2}, attempts: 3, err: true},
+	}
+
+	for _, tt := range tests {
+		g := newTestGrader(t, nil, nil)
+		jobDir, err := ioutil.TempDir("", "grader_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(jobDir)
+
+		commands := []Command{tt.command, {Argv: next}}
+		failed, err := g.runCommands(context.Background(), commands, jobDir, nil, "", SetupStage, nil)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.err)
+		}
+		if !reflect.DeepEqual(failed, tt.failed) {
+			t.Errorf("%s: got failed commands %v, want %v", tt.name, failed, tt.failed)
+		}
+
+		b, _ := ioutil.ReadFile(filepath.Join(jobDir, "attempts"))
+		if got := strings.Count(string(b), "attempt"); got != tt.attempts {
+			t.Errorf("%s: command ran %d times, want %d", tt.name, got, tt.attempts)
+		}
+		if _, err := os.Stat(filepath.Join(jobDir, "next")); (err == nil) != tt.next {
+			t.Errorf("%s: got next command run %v, want %v", tt.name, err == nil, tt.next)
+		}
+	}
+}
+
+func TestGradeSetupFailed(t *testing.T) {
+	setup := []Command{{
+		Argv:      []string{"sh", "-c", "echo missing tests.zip >&2; exit 2"},
+		OnFailure: FailureAbort,
+	}}
+	g := newTestGrader(t, setup, []string{"sh", "-c", "touch graded"})
+
+	result, err := g.Grade(context.Background(), "g1", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Grading.Status != StatusSetupFailed {
+		t.Errorf("got status %s, want %s", result.Grading.Status, StatusSetupFailed)
+	}
+	if !strings.Contains(result.Grading.Message, "setup[0]") {
+		t.Errorf("got message %q, want it to name the failed command", result.Grading.Message)
+	}
+	if result.Grading.Feedback != "missing tests.zip\n" {
+		t.Errorf("got feedback %q, want the setup command's output", result.Grading.Feedback)
+	}
+}
+
+func TestRunInitRecordsFailures(t *testing.T) {
+	g := newTestGrader(t, nil, nil)
+	commands := []Command{
+		{Argv: []string{"true"}},
+		{Argv: []string{"false"}},
+		{Argv: []string{"true"}},
+	}
+
+	if err := g.RunInit(context.Background(), commands); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.InitFailures(); !reflect.DeepEqual(got, []string{"init[1]"}) {
+		t.Errorf("got init failures %v, want [init[1]]", got)
+	}
+
+	if err := g.RunInit(context.Background(), commands[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.InitFailures(); len(got) != 0 {
+		t.Errorf("got init failures %v after init succeeded", got)
+	}
+}
+
+func TestCommandsGetAutogradRoot(t *testing.T) {
+	g := newTestGrader(t, nil, nil)
+	commands := []Command{{Argv: []string{"sh", "-c", `printf %s "$AUTOGRAD_ROOT" > root`}}}
+
+	if err := g.RunInit(context.Background(), commands); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(g.graderRoot, "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != g.autogradRoot {
+		t.Errorf("got AUTOGRAD_ROOT %q, want %q", b, g.autogradRoot)
+	}
+}
@@ -1,39 +1,296 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strconv"
+	"strings"
 
-	"gopkg.in/yaml.v2"
+	autogradconfig "github.com/PrairieLearn/autograd/config"
 )
 
 const (
 	configFileName = "configuration.yml"
+
+	// Failure policies, as written in on_failure. They are the values of
+	// grader.FailurePolicy.
+	FailureAbort    = "abort"
+	FailureContinue = "continue"
+	FailureRetry    = "retry"
 )
 
+// feedbackStreams are the values of output.feedback, and stdout and stderr
+// those of output.streams. They are the values of grader.FeedbackStream.
+var feedbackStreams = []string{"combined", "stdout", "stderr", "none"}
+
 type Config struct {
 	Grader GraderConfig `yaml:"grader"`
 }
 
 type GraderConfig struct {
-	InitCommands    [][]string `yaml:"init_commands"`
-	SetupCommands   [][]string `yaml:"setup_commands"`
-	GradeCommand    []string   `yaml:"grade_command"`
-	CleanupCommands [][]string `yaml:"cleanup_commands"`
-	GradeTimeout    int        `yaml:"grade_timeout"`
+	InitCommands  []Command `yaml:"init_commands"`
+	ProfileConfig `yaml:",inline"`
+	Profiles      map[string]ProfileConfig `yaml:"profiles"`
+	Sandbox       SandboxConfig            `yaml:"sandbox"`
+	Limits        LimitsConfig             `yaml:"limits"`
+	Output        OutputConfig             `yaml:"output"`
+	// ResultsFile reads the score from results.json instead of the grade
+	// command's exit code, and PartialResults keeps it when the grade
+	// command fails.
+	ResultsFile    bool `yaml:"results_file"`
+	PartialResults bool `yaml:"partial_results"`
+	// KillGracePeriod is in seconds; nil means the default.
+	KillGracePeriod *int            `yaml:"kill_grace_period"`
+	SelfTest        []FixtureConfig `yaml:"selftest"`
+}
+
+// FixtureConfig is a self-test job and its expected result. The job is given
+// either inline or as a JSON file relative to the grader repo.
+type FixtureConfig struct {
+	Name     string                 `yaml:"name"`
+	Job      map[string]interface{} `yaml:"job"`
+	JobFile  string                 `yaml:"job_file"`
+	Status   string                 `yaml:"status"`
+	MinScore *float64               `yaml:"min_score"`
+	MaxScore *float64               `yaml:"max_score"`
+}
+
+type ProfileConfig struct {
+	SetupCommands   []Command `yaml:"setup_commands"`
+	GradeCommand    []string  `yaml:"grade_command"`
+	CleanupCommands []Command `yaml:"cleanup_commands"`
+	GradeTimeout    int       `yaml:"grade_timeout"`
+}
+
+// Command is an init, setup or cleanup command. It is written either as a
+// plain argv list or as a map with the argv under command and its other
+// settings alongside.
+type Command struct {
+	Command      []string          `yaml:"command"`
+	OnFailure    string            `yaml:"on_failure"`
+	AllowFailure bool              `yaml:"allow_failure"`
+	Timeout      int               `yaml:"timeout"`
+	Env          map[string]string `yaml:"env"`
+	Dir          string            `yaml:"dir"`
+}
+
+func (c *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.Command); err == nil {
+		return nil
+	}
+
+	type command Command
+	return unmarshal((*command)(c))
+}
+
+type SandboxConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	ReadOnlyPaths []string `yaml:"read_only_paths"`
+	AllowNetwork  bool     `yaml:"allow_network"`
+	UIDBase       int      `yaml:"uid_base"`
+}
+
+type LimitsConfig struct {
+	Init    StageLimitsConfig `yaml:"init"`
+	Setup   StageLimitsConfig `yaml:"setup"`
+	Grade   StageLimitsConfig `yaml:"grade"`
+	Cleanup StageLimitsConfig `yaml:"cleanup"`
+}
+
+type StageLimitsConfig struct {
+	AddressSpaceMB int64 `yaml:"address_space_mb"`
+	CPUSeconds     int64 `yaml:"cpu_seconds"`
+	MemoryMB       int64 `yaml:"memory_mb"`
+	Processes      int64 `yaml:"processes"`
+	FileSizeMB     int64 `yaml:"file_size_mb"`
+	OpenFiles      int64 `yaml:"open_files"`
+}
+
+type OutputConfig struct {
+	HeadBytes  int               `yaml:"head_bytes"`
+	TailBytes  int               `yaml:"tail_bytes"`
+	SpillDir   string            `yaml:"spill_dir"`
+	Feedback   string            `yaml:"feedback"`
+	Streams    []string          `yaml:"streams"`
+	Timestamps bool              `yaml:"timestamps"`
+	Init       StageOutputConfig `yaml:"init"`
+	Setup      StageOutputConfig `yaml:"setup"`
+	Grade      StageOutputConfig `yaml:"grade"`
+	Cleanup    StageOutputConfig `yaml:"cleanup"`
+}
+
+// StageOutputConfig overrides the output limits for one stage's commands.
+type StageOutputConfig struct {
+	HeadBytes int `yaml:"head_bytes"`
+	TailBytes int `yaml:"tail_bytes"`
 }
 
 func Load(graderRoot string) (*Config, error) {
-	file, err := ioutil.ReadFile(filepath.Join(graderRoot, configFileName))
+	return LoadFile(filepath.Join(graderRoot, configFileName))
+}
+
+// LoadFile loads and validates a grader configuration file. Unknown keys and
+// invalid values are reported together in a *config.ValidationError.
+func LoadFile(path string) (*Config, error) {
+	file, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
 	var config Config
-	err = yaml.Unmarshal(file, &config)
+	problems, err := autogradconfig.UnmarshalStrict(file, &config)
 	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	config.Grader.validate(problems)
+	if err := problems.Err(path); err != nil {
 		return nil, err
 	}
 
 	return &config, nil
 }
+
+func (c *GraderConfig) validate(p *autogradconfig.Problems) {
+	validateCommands(p, "grader.init_commands", c.InitCommands)
+	c.ProfileConfig.validate(p, "grader")
+	for name, profile := range c.Profiles {
+		profile.validate(p, "grader.profiles."+name)
+	}
+
+	if c.Sandbox.UIDBase < 0 {
+		p.Addf("grader.sandbox.uid_base", "must not be negative, got %d", c.Sandbox.UIDBase)
+	}
+	c.Limits.Init.validate(p, "grader.limits.init")
+	c.Limits.Setup.validate(p, "grader.limits.setup")
+	c.Limits.Grade.validate(p, "grader.limits.grade")
+	c.Limits.Cleanup.validate(p, "grader.limits.cleanup")
+
+	c.Output.validate(p, "grader.output")
+	c.Output.Init.validate(p, "grader.output.init")
+	c.Output.Setup.validate(p, "grader.output.setup")
+	c.Output.Grade.validate(p, "grader.output.grade")
+	c.Output.Cleanup.validate(p, "grader.output.cleanup")
+	if c.Output.Feedback != "" && !contains(feedbackStreams, c.Output.Feedback) {
+		p.Addf("grader.output.feedback", "must be combined, stdout, stderr or none, not %q", c.Output.Feedback)
+	}
+	for i, stream := range c.Output.Streams {
+		if stream != "stdout" && stream != "stderr" {
+			p.Addf(fmt.Sprintf("grader.output.streams[%d]", i), "must be stdout or stderr, not %q", stream)
+		}
+	}
+
+	if c.PartialResults && !c.ResultsFile {
+		p.Addf("grader.partial_results", "must not be set without results_file")
+	}
+
+	if c.KillGracePeriod != nil && *c.KillGracePeriod < 0 {
+		p.Addf("grader.kill_grace_period", "must not be negative, got %d", *c.KillGracePeriod)
+	}
+
+	for i, f := range c.SelfTest {
+		path := fmt.Sprintf("grader.selftest[%d]", i)
+		if (f.Job == nil) == (f.JobFile == "") {
+			p.Addf(path, "must set exactly one of job and job_file")
+		}
+		if f.MinScore != nil && f.MaxScore != nil && *f.MinScore > *f.MaxScore {
+			p.Addf(path+".min_score", "must not be above max_score, got %g > %g", *f.MinScore, *f.MaxScore)
+		}
+	}
+}
+
+func (c *ProfileConfig) validate(p *autogradconfig.Problems, path string) {
+	validateCommands(p, path+".setup_commands", c.SetupCommands)
+	validateCommands(p, path+".cleanup_commands", c.CleanupCommands)
+	if len(c.GradeCommand) == 0 {
+		p.Addf(path+".grade_command", "is required")
+	}
+	if c.GradeTimeout <= 0 {
+		p.Addf(path+".grade_timeout", "must be positive, got %d", c.GradeTimeout)
+	}
+}
+
+func validateCommands(p *autogradconfig.Problems, path string, commands []Command) {
+	for i, c := range commands {
+		path := fmt.Sprintf("%s[%d]", path, i)
+		if len(c.Command) == 0 {
+			p.Addf(path, "command is empty")
+		}
+		policy, _, err := ParseFailurePolicy(c.OnFailure)
+		if err != nil {
+			p.Addf(path+".on_failure", "%v", err)
+		}
+		if c.AllowFailure && policy != "" && policy != FailureContinue {
+			p.Addf(path+".allow_failure", "must not be set with on_failure %q", c.OnFailure)
+		}
+		if c.Timeout < 0 {
+			p.Addf(path+".timeout", "must not be negative, got %d", c.Timeout)
+		}
+	}
+}
+
+// ParseFailurePolicy parses an on_failure value of the form "abort",
+// "continue" or "retry N", returning the policy and number of retries.
+func ParseFailurePolicy(s string) (string, int, error) {
+	fields := strings.Fields(s)
+	switch {
+	case len(fields) == 0:
+		return "", 0, nil
+	case len(fields) == 1 && (fields[0] == FailureAbort || fields[0] == FailureContinue):
+		return fields[0], 0, nil
+	case len(fields) == 2 && fields[0] == FailureRetry:
+		retries, err := strconv.Atoi(fields[1])
+		if err != nil || retries < 1 {
+			return "", 0, fmt.Errorf("Invalid retry count in failure policy %q", s)
+		}
+		return FailureRetry, retries, nil
+	}
+	return "", 0, fmt.Errorf("Invalid failure policy %q, must be abort, continue or retry N", s)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *OutputConfig) validate(p *autogradconfig.Problems, path string) {
+	if c.HeadBytes < 0 {
+		p.Addf(path+".head_bytes", "must not be negative, got %d", c.HeadBytes)
+	}
+	if c.TailBytes < 0 {
+		p.Addf(path+".tail_bytes", "must not be negative, got %d", c.TailBytes)
+	}
+}
+
+func (c *StageOutputConfig) validate(p *autogradconfig.Problems, path string) {
+	if c.HeadBytes < 0 {
+		p.Addf(path+".head_bytes", "must not be negative, got %d", c.HeadBytes)
+	}
+	if c.TailBytes < 0 {
+		p.Addf(path+".tail_bytes", "must not be negative, got %d", c.TailBytes)
+	}
+}
+
+func (c *StageLimitsConfig) validate(p *autogradconfig.Problems, path string) {
+	limits := []struct {
+		key   string
+		value int64
+	}{
+		{"address_space_mb", c.AddressSpaceMB},
+		{"cpu_seconds", c.CPUSeconds},
+		{"memory_mb", c.MemoryMB},
+		{"processes", c.Processes},
+		{"file_size_mb", c.FileSizeMB},
+		{"open_files", c.OpenFiles},
+	}
+	for _, limit := range limits {
+		if limit.value < 0 {
+			p.Addf(path+"."+limit.key, "must not be negative, got %d", limit.value)
+		}
+	}
+}
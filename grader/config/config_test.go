@@ -0,0 +1,93 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	autogradconfig "github.com/PrairieLearn/autograd/config"
+)
+
+func TestParseFailurePolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		policy  string
+		retries int
+		err     bool
+	}{
+		{in: "", policy: ""},
+		{in: "abort", policy: FailureAbort},
+		{in: "continue", policy: FailureContinue},
+		{in: "retry 3", policy: FailureRetry, retries: 3},
+		{in: "  retry   1 ", policy: FailureRetry, retries: 1},
+		{in: "retry", err: true},
+		{in: "retry 0", err: true},
+		{in: "retry -1", err: true},
+		{in: "retry many", err: true},
+		{in: "abort 2", err: true},
+		{in: "ignore", err: true},
+	}
+
+	for _, tt := range tests {
+		policy, retries, err := ParseFailurePolicy(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseFailurePolicy(%q): got error %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if policy != tt.policy || retries != tt.retries {
+			t.Errorf("ParseFailurePolicy(%q) = %q, %d, want %q, %d", tt.in, policy, retries, tt.policy, tt.retries)
+		}
+	}
+}
+
+func TestLoadFileReportsIndexedPaths(t *testing.T) {
+	in := `grader:
+  grade_command: ["./grade.sh"]
+  grade_timeout: 30
+  partial_results: true
+  setup_commands:
+    - ["true"]
+    - command: ["./fetch.sh"]
+      on_failure: retry
+  output:
+    feedback: both
+    streams: [stdout, combined]
+  selftest:
+    - name: ok
+      job: {gid: g1}
+    - name: both
+      job: {gid: g2}
+      job_file: job.json
+      min_score: 5
+      max_score: 1
+`
+	want := []string{
+		`line 8: grader.setup_commands[1].on_failure: Invalid failure policy "retry", must be abort, continue or retry N`,
+		`line 10: grader.output.feedback: must be combined, stdout, stderr or none, not "both"`,
+		`grader.output.streams[1]: must be stdout or stderr, not "combined"`,
+		`line 4: grader.partial_results: must not be set without results_file`,
+		`line 15: grader.selftest[1]: must set exactly one of job and job_file`,
+		`line 18: grader.selftest[1].min_score: must not be above max_score, got 5 > 1`,
+	}
+
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, configFileName)
+	if err := ioutil.WriteFile(path, []byte(in), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadFile(path)
+	verr, ok := err.(*autogradconfig.ValidationError)
+	if !ok {
+		t.Fatalf("got error %v, want a *ValidationError", err)
+	}
+	if !reflect.DeepEqual(verr.Problems, want) {
+		t.Errorf("got problems\n  %q\nwant\n  %q", verr.Problems, want)
+	}
+}
@@ -0,0 +1,49 @@
+package grader
+
+const (
+	execInitArg = "__autograd_exec_init"
+	execEnvKey  = "_AUTOGRAD_EXEC_SPEC"
+)
+
+// execSpec describes how a command is confined. Commands with a non-empty
+// spec are started through the exec init process, a re-exec of the autograd
+// binary which is the one place a command is confined. In order, it
+//
+//   - joins the command's cgroup, which enforces the memory and processes
+//     limits if cgroup v2 is available
+//   - enters the sandbox: new namespaces, a chroot and the job's uid
+//   - applies the remaining limits with setrlimit
+//   - execs the command, or in a sandbox starts it and stays on as the
+//     init of its pid namespace
+//
+// It reports errors, and the command's status when it waited for it, back
+// to autograd over a pipe.
+type execSpec struct {
+	Sandbox *sandboxSpec `json:"sandbox,omitempty"`
+	Limits  *Limits      `json:"limits,omitempty"`
+	Cgroup  string       `json:"cgroup,omitempty"` // directory of the cgroup to join
+}
+
+func (s *execSpec) empty() bool {
+	return s == nil || (s.Sandbox == nil && s.Cgroup == "" && (s.Limits == nil || *s.Limits == Limits{}))
+}
+
+func (s *execSpec) limits() *Limits {
+	if s == nil {
+		return nil
+	}
+	return s.Limits
+}
+
+// withCgroup returns a copy of s for a command in the cgroup at dir, which
+// enforces the processes limit instead of setrlimit.
+func (s *execSpec) withCgroup(dir string) *execSpec {
+	spec := *s
+	spec.Cgroup = dir
+	if s.Limits != nil {
+		limits := *s.Limits
+		limits.Processes = 0
+		spec.Limits = &limits
+	}
+	return &spec
+}
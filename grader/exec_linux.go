@@ -0,0 +1,205 @@
+//go:build linux
+// +build linux
+
+package grader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == execInitArg {
+		execInit()
+	}
+}
+
+// forwardedSignals are passed on to the command by the exec init process
+// when it stays on as the init of a sandbox's pid namespace.
+var forwardedSignals = []os.Signal{
+	syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2,
+}
+
+// execProcess reads the report of the exec init process, which it writes to
+// a pipe if it fails to start the command or once the command exits. The
+// pipe is closed without a report when the init process execs the command.
+type execProcess struct {
+	r, w *os.File
+}
+
+// execReport is the report of the exec init process: the error it failed
+// with, or the status and resource usage of the command it waited for.
+type execReport struct {
+	Error  string              `json:"error,omitempty"`
+	Status *syscall.WaitStatus `json:"status,omitempty"`
+	Rusage *syscall.Rusage     `json:"rusage,omitempty"`
+}
+
+// wrap returns a command which starts the exec init process with the
+// settings of cmd. The init process applies the spec and then runs argv.
+func (spec *execSpec) wrap(cmd *exec.Cmd, argv []string) (*exec.Cmd, *execProcess, error) {
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped := exec.Command("/proc/self/exe", append([]string{execInitArg}, argv...)...)
+	wrapped.Dir = cmd.Dir
+	wrapped.Env = append(cmd.Env, execEnvKey+"="+string(encoded))
+	wrapped.Stdout = cmd.Stdout
+	wrapped.Stderr = cmd.Stderr
+	wrapped.ExtraFiles = []*os.File{w}
+	wrapped.SysProcAttr = cmd.SysProcAttr
+	if spec.Sandbox != nil {
+		wrapped.Env = append(wrapped.Env, "TMPDIR="+spec.Sandbox.JobDir)
+		wrapped.SysProcAttr.Cloneflags = syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWUTS
+		if !spec.Sandbox.AllowNetwork {
+			wrapped.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+		}
+	}
+
+	return wrapped, &execProcess{r: r, w: w}, nil
+}
+
+// started closes the parent's copy of the report pipe once the child has it.
+func (p *execProcess) started() {
+	p.w.Close()
+	p.w = nil
+}
+
+// exitStatus returns how the command exited, given the status and resource
+// usage of the exec init process. They are the command's own unless the init
+// process waited for the command, in which case it reports the command's. It
+// must only be called once the process has exited.
+func (p *execProcess) exitStatus(status syscall.WaitStatus, rusage *syscall.Rusage) (
+	syscall.WaitStatus, *syscall.Rusage, error) {
+	defer p.r.Close()
+
+	var report execReport
+	if err := json.NewDecoder(p.r).Decode(&report); err == io.EOF {
+		return status, rusage, nil
+	} else if err != nil {
+		return 0, nil, fmt.Errorf("Reading exec init report: %v", err)
+	}
+	if report.Error != "" {
+		return 0, nil, fmt.Errorf("Command setup failed: %s", report.Error)
+	}
+	if report.Status == nil {
+		return 0, nil, fmt.Errorf("Exec init report has no status")
+	}
+	return *report.Status, report.Rusage, nil
+}
+
+// close closes the ends of the report pipe that are still open, for when the
+// report will not be read.
+func (p *execProcess) close() {
+	if p.w != nil {
+		p.w.Close()
+	}
+	p.r.Close()
+}
+
+// execInit runs in the child process started by wrap. It never returns.
+//
+// Without a sandbox it applies the limits and execs the command. In a
+// sandbox it is pid 1 of a new pid namespace, which the kernel protects from
+// signals it does not handle and which inherits every orphaned process, so it
+// stays on as a minimal init: it starts the command in its own process
+// group, forwards signals to that group and reaps children until the command
+// exits. Exiting then kills whatever the command left running in the
+// namespace.
+func execInit() {
+	reportPipe := os.NewFile(3, "exec-report")
+	syscall.CloseOnExec(3)
+
+	fail := func(err error) {
+		json.NewEncoder(reportPipe).Encode(execReport{Error: err.Error()})
+		os.Exit(1)
+	}
+
+	var spec execSpec
+	if err := json.Unmarshal([]byte(os.Getenv(execEnvKey)), &spec); err != nil {
+		fail(err)
+	}
+	os.Unsetenv(execEnvKey)
+
+	if spec.Cgroup != "" {
+		if err := joinCgroup(spec.Cgroup); err != nil {
+			fail(fmt.Errorf("joining cgroup: %v", err))
+		}
+	}
+	if spec.Sandbox != nil {
+		if err := spec.Sandbox.enter(); err != nil {
+			fail(err)
+		}
+	}
+
+	argv := os.Args[2:]
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		fail(err)
+	}
+
+	if spec.Sandbox == nil {
+		if spec.Limits != nil {
+			if err := spec.Limits.apply(); err != nil {
+				fail(err)
+			}
+		}
+		fail(syscall.Exec(path, argv, os.Environ()))
+	}
+
+	// The signal forwarder is started before the limits are applied to this
+	// process, so they do not get in the way of the runtime setting it up.
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, forwardedSignals...)
+	child := make(chan int, 1)
+	go func() {
+		pid := <-child
+		for sig := range signals {
+			syscall.Kill(-pid, sig.(syscall.Signal))
+		}
+	}()
+
+	if spec.Limits != nil {
+		if err := spec.Limits.apply(); err != nil {
+			fail(err)
+		}
+	}
+	pid, err := syscall.ForkExec(path, argv, &syscall.ProcAttr{
+		Env:   os.Environ(),
+		Files: []uintptr{0, 1, 2},
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	})
+	if err != nil {
+		fail(err)
+	}
+	child <- pid
+
+	for {
+		var status syscall.WaitStatus
+		var rusage syscall.Rusage
+		wpid, err := syscall.Wait4(-1, &status, 0, &rusage)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			fail(err)
+		}
+		if wpid == pid {
+			json.NewEncoder(reportPipe).Encode(execReport{Status: &status, Rusage: &rusage})
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+//go:build linux
+// +build linux
+
+package grader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSandboxUID = 20000
+
+// newTestSandbox returns a sandbox for a new job directory, skipping the test
+// if sandboxes cannot be created.
+func newTestSandbox(t *testing.T) (*execSpec, string) {
+	if os.Geteuid() != 0 {
+		t.Skip("sandbox needs root")
+	}
+
+	root, err := ioutil.TempDir("", "sandbox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobDir, err := ioutil.TempDir("", "sandbox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(root)
+		os.RemoveAll(jobDir)
+	})
+	if err := chownAll(jobDir, testSandboxUID); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &execSpec{Sandbox: &sandboxSpec{
+		Root:          root,
+		JobDir:        jobDir,
+		ReadOnlyPaths: defaultSandboxReadOnlyPaths,
+		UID:           testSandboxUID,
+	}}
+	if _, err := execWithTimeout(context.Background(), []string{"true"}, jobDir, nil, 5*time.Second, 0, spec,
+		ioutil.Discard, ioutil.Discard); err != nil {
+		t.Skipf("cannot create sandbox: %v", err)
+	}
+	return spec, jobDir
+}
+
+func TestSandboxInitForwardsSIGTERM(t *testing.T) {
+	spec, jobDir := newTestSandbox(t)
+
+	script := `trap 'echo stopped > stopped; exit 1' TERM; sleep 10 & wait`
+	_, err := execWithTimeout(context.Background(), []string{"sh", "-c", script}, jobDir, nil,
+		200*time.Millisecond, 5*time.Second, spec, ioutil.Discard, ioutil.Discard)
+	if _, ok := err.(*timeoutError); !ok {
+		t.Errorf("got error %v, want timeout", err)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(jobDir, "stopped")); err != nil || string(b) != "stopped\n" {
+		t.Errorf("command did not handle SIGTERM: %q, %v", b, err)
+	}
+}
+
+func TestSandboxInitReportsCommandStatus(t *testing.T) {
+	spec, jobDir := newTestSandbox(t)
+
+	tests := []struct {
+		script string
+		code   int
+		err    string
+	}{
+		{script: "exit 7", code: 7},
+		{script: "sleep 10 & exit 3", code: 3},
+		{script: "kill -s SEGV 0", err: "killed by signal"},
+	}
+
+	for _, tt := range tests {
+		start := time.Now()
+		code, err := execWithTimeout(context.Background(), []string{"sh", "-c", tt.script}, jobDir, nil,
+			5*time.Second, 0, spec, ioutil.Discard, ioutil.Discard)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.script, err, tt.err)
+			}
+		} else if err != nil || code != tt.code {
+			t.Errorf("%q: got %d, %v, want %d", tt.script, code, err, tt.code)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("%q: took %s, leftover processes were not killed", tt.script, elapsed)
+		}
+	}
+}
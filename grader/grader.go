@@ -1,6 +1,10 @@
 package grader
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -12,6 +16,8 @@ import (
 
 type Stage string
 
+type Status string
+
 const (
 	graderDir   = "_grader"
 	jobPrefix   = "job_"
@@ -21,30 +27,161 @@ const (
 	SetupStage   Stage = "setup"
 	GradeStage   Stage = "grade"
 	CleanupStage Stage = "cleanup"
+
+	// StatusSucceeded means the grade command ran to completion. It says
+	// nothing about the score the submission received.
+	StatusSucceeded Status = "succeeded"
+	// StatusTimedOut means the grade command ran past its timeout.
+	StatusTimedOut Status = "timed_out"
+	// StatusGraderCrashed means the grade command could not be run, was
+	// killed by a signal or wrote invalid results.
+	StatusGraderCrashed Status = "grader_crashed"
+	// StatusSetupFailed means a setup command failed and the grade command
+	// was not run.
+	StatusSetupFailed Status = "setup_failed"
+	// StatusLimitExceeded means the grade command was killed for exceeding
+	// a resource limit.
+	StatusLimitExceeded Status = "limit_exceeded"
+	// StatusInternalError means autograd itself failed to grade the job.
+	StatusInternalError Status = "internal_error"
 )
 
 type Grader struct {
-	autogradRoot    string
-	setupCommands   [][]string
+	autogradRoot string
+	graderRoot   string
+	profile
+	profiles map[string]*profile
+	sandbox  *sandboxConfig // nil if grade commands are not sandboxed
+	limits   map[Stage]*Limits
+
+	output    outputOptions
+	results   resultsOptions
+	killGrace time.Duration
+	commit    string // grader repo commit, for status reporting
+	fixtures  []Fixture
+
+	initFailures []string // init commands which failed without aborting init
+	recorder     recorder
+}
+
+// profile is a set of commands used to grade a job. Jobs select a named
+// profile with their grader_profile field, and use the Grader's default
+// profile otherwise.
+type profile struct {
+	setupCommands   []Command
 	gradeCommand    []string
-	cleanupCommands [][]string
+	cleanupCommands []Command
 	gradeTimeout    time.Duration
 }
 
+// ResultSchemaVersion is the version of the Result JSON format. Version 1
+// sent feedback as base64-encoded bytes.
+const ResultSchemaVersion = 2
+
 type Result struct {
-	GID     string  `json:"gid"`
-	Grading Grading `json:"grading"`
+	SchemaVersion int     `json:"schema_version"`
+	GID           string  `json:"gid"`
+	Grading       Grading `json:"grading"`
 }
 
+// FeedbackFormat says how the feedback in a Grading is encoded.
+type FeedbackFormat string
+
+const (
+	// FeedbackText feedback is a UTF-8 string of the grade command's output.
+	FeedbackText FeedbackFormat = "text"
+	// FeedbackJSON feedback is the JSON object the grade command wrote as
+	// feedback in results.json.
+	FeedbackJSON FeedbackFormat = "json"
+)
+
 type Grading struct {
-	Score    int    `json:"score"`
-	Feedback []byte `json:"feedback"`
+	Status    Status     `json:"status"`
+	Message   string     `json:"message,omitempty"`
+	Score     float64    `json:"score"`
+	Partial   bool       `json:"partial,omitempty"` // results written by a grade command which did not succeed
+	MaxPoints float64    `json:"max_points,omitempty"`
+	TestCases []TestCase `json:"test_cases,omitempty"`
+	Messages  []string   `json:"messages,omitempty"`
+	// Feedback is a string for FeedbackText and a json.RawMessage for
+	// FeedbackJSON.
+	Feedback       interface{}    `json:"feedback"`
+	FeedbackFormat FeedbackFormat `json:"feedback_format"`
+	Stdout         string         `json:"stdout,omitempty"`
+	Stderr         string         `json:"stderr,omitempty"`
+	Output         []OutputChunk  `json:"output,omitempty"`
+}
+
+type TestCase struct {
+	Name      string  `json:"name"`
+	Points    float64 `json:"points"`
+	MaxPoints float64 `json:"max_points"`
+	Message   string  `json:"message,omitempty"`
 }
 
-func New(autogradRoot string, setupCommands [][]string, gradeCommand []string, cleanupCommands [][]string,
-	gradeTimeout int) *Grader {
+func New(autogradRoot, graderRoot string, setupCommands []Command, gradeCommand []string,
+	cleanupCommands []Command, gradeTimeout int) *Grader {
 	return &Grader{
-		autogradRoot:    autogradRoot,
+		autogradRoot: autogradRoot,
+		graderRoot:   graderRoot,
+		profile: profile{
+			setupCommands:   setupCommands,
+			gradeCommand:    gradeCommand,
+			cleanupCommands: cleanupCommands,
+			gradeTimeout:    time.Duration(gradeTimeout) * time.Second,
+		},
+		profiles: make(map[string]*profile),
+		limits:   make(map[Stage]*Limits),
+		output: outputOptions{
+			limits:   make(map[Stage]OutputLimit),
+			feedback: FeedbackCombined,
+			log:      os.Stdout,
+		},
+		killGrace: DefaultKillGracePeriod,
+		recorder:  defaultRecorder,
+	}
+}
+
+// SetCommit records the grader repo commit the Grader was loaded from.
+func (g *Grader) SetCommit(commit string) {
+	g.commit = commit
+}
+
+// resultsOptions say where the score of a job comes from.
+type resultsOptions struct {
+	// file reads the score from results.json in the job directory instead
+	// of taking the grade command's exit code.
+	file bool
+	// partial keeps the score of a results.json written before the grade
+	// command timed out, exceeded a limit or crashed. The job can write to
+	// its directory, so this is only safe for graders which write
+	// results.json somewhere the job cannot tamper with it first.
+	partial bool
+}
+
+// SetResults sets whether the score is read from results.json rather than
+// taken from the grade command's exit code, which is the default, and
+// whether results.json is used when the grade command fails.
+func (g *Grader) SetResults(file, partial bool) error {
+	if partial && !file {
+		return errors.New("Partial results need results to be read from results.json")
+	}
+	g.results = resultsOptions{file: file, partial: partial}
+	return nil
+}
+
+// SetKillGracePeriod sets how long commands have to exit after SIGTERM, when
+// they time out or grading is canceled, before they are sent SIGKILL. A grace
+// period of 0 sends SIGKILL straight away.
+func (g *Grader) SetKillGracePeriod(grace time.Duration) {
+	g.killGrace = grace
+}
+
+// AddProfile adds a named profile which jobs can select instead of the
+// default commands passed to New.
+func (g *Grader) AddProfile(name string, setupCommands []Command, gradeCommand []string,
+	cleanupCommands []Command, gradeTimeout int) {
+	g.profiles[name] = &profile{
 		setupCommands:   setupCommands,
 		gradeCommand:    gradeCommand,
 		cleanupCommands: cleanupCommands,
@@ -52,7 +189,36 @@ func New(autogradRoot string, setupCommands [][]string, gradeCommand []string, c
 	}
 }
 
-func (g *Grader) Grade(gid string, jobData []byte) (*Result, error) {
+// RunInit runs the grader repo's init commands in the grader root. It is the
+// last step of loading a Grader, once it is otherwise set up. Commands which
+// fail without aborting init are reported by InitFailures.
+func (g *Grader) RunInit(ctx context.Context, commands []Command) error {
+	env := map[string]string{
+		"AUTOGRAD_ROOT":        g.autogradRoot,
+		"AUTOGRAD_GRADER_ROOT": g.graderRoot,
+	}
+	failed, err := g.runCommands(ctx, commands, g.graderRoot, env, "", InitStage, g.execSpec(InitStage, nil))
+	g.initFailures = failed
+	return err
+}
+
+// InitFailures returns the names of the init commands which failed the last
+// time RunInit ran, such as "init[1]".
+func (g *Grader) InitFailures() []string {
+	return g.initFailures
+}
+
+// Grade grades a job. If ctx is canceled, the running command is stopped,
+// cleanup commands are run and Grade returns ctx's error instead of a result.
+func (g *Grader) Grade(ctx context.Context, gid string, jobData []byte) (result *Result, err error) {
+	p, err := g.selectProfile(jobData)
+	if err != nil {
+		return nil, err
+	}
+
+	job := g.recorder.startJob(gid, g.commit)
+	defer job.finish()
+
 	jobDir, err := ioutil.TempDir(g.autogradRoot, jobPrefix)
 	if err != nil {
 		return nil, err
@@ -75,29 +241,140 @@ func (g *Grader) Grade(gid string, jobData []byte) (*Result, error) {
 	}()
 
 	env := map[string]string{
-		"AUTOGRAD_GRADER_ROOT": GetGraderRoot(g.autogradRoot),
+		"AUTOGRAD_ROOT":        g.autogradRoot,
+		"AUTOGRAD_GRADER_ROOT": g.graderRoot,
 		"AUTOGRAD_JOB_DIR":     jobDir,
 	}
 
-	RunCommands(g.setupCommands, jobDir, env, gid, "setup")
-	score, feedback := runGradeCommand(g.gradeCommand, jobDir, env, gid, g.gradeTimeout)
-	RunCommands(g.cleanupCommands, jobDir, env, gid, "cleanup")
+	// The sandbox is released after cleanup, which runs in it too.
+	var sandbox *sandboxSpec
+	if g.sandbox != nil {
+		var release func()
+		sandbox, release, err = g.sandbox.newSandboxSpec(g.autogradRoot, jobDir, env)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	// Cleanup runs however grading ends, including after a panic, which is
+	// turned into an error so the job gets a result. It is not canceled with
+	// ctx, so the job directory is always cleaned up.
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{"gid": gid}).Errorf("Panic while grading: %v", r)
+			result, err = nil, fmt.Errorf("Panic while grading: %v", r)
+		}
+		job.setStage(CleanupStage)
+		start := time.Now()
+		_, cerr := g.runCommands(context.Background(), p.cleanupCommands, jobDir, env, gid, CleanupStage,
+			g.execSpec(CleanupStage, sandbox))
+		g.recorder.observe(stageDuration, time.Since(start).Seconds(), string(CleanupStage))
+		if cerr != nil {
+			log.WithFields(log.Fields{"gid": gid}).Warnf("Cleanup failed: %v", cerr)
+			g.recorder.inc(stageFailures, string(CleanupStage))
+		}
+		if result != nil {
+			g.recorder.inc(gradingResults, string(result.Grading.Status))
+		}
+	}()
+
+	start := time.Now()
+	_, err = g.runCommands(ctx, p.setupCommands, jobDir, env, gid, SetupStage, g.execSpec(SetupStage, sandbox))
+	g.recorder.observe(stageDuration, time.Since(start).Seconds(), string(SetupStage))
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"gid": gid}).Warnf("Setup failed: %v", err)
+		g.recorder.inc(stageFailures, string(SetupStage))
+		return g.setupFailedResult(gid, err), nil
+	}
+
+	job.setStage(GradeStage)
+	start = time.Now()
+	grading := runGradeCommand(ctx, p.gradeCommand, jobDir, env, gid, p.gradeTimeout, g.killGrace,
+		g.execSpec(GradeStage, sandbox), g.output, g.results, g.recorder)
+	g.recorder.observe(stageDuration, time.Since(start).Seconds(), string(GradeStage))
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if grading.MaxPoints > 0 {
+		g.recorder.observe(gradingScore, grading.Score/grading.MaxPoints)
+	}
+
+	return &Result{
+		SchemaVersion: ResultSchemaVersion,
+		GID:           gid,
+		Grading:       grading,
+	}, nil
+}
+
+// setupFailedResult returns the result for a job whose setup failed with
+// err, with the failed command's output as feedback.
+func (g *Grader) setupFailedResult(gid string, err error) *Result {
+	serr, ok := err.(*stageError)
+	if !ok {
+		return NewErrorResult(gid, StatusSetupFailed, "The grader failed to set up your submission")
+	}
+
+	result := NewErrorResult(gid, StatusSetupFailed,
+		fmt.Sprintf("The grader failed to set up your submission: %v", serr))
+	if g.output.feedback != FeedbackNone {
+		result.Grading.Feedback = sanitizeUTF8(serr.output)
+	}
+	return result
+}
+
+// execSpec returns how commands run in stage are confined. Setup and cleanup
+// commands share the grade command's sandbox, with the grader root also
+// visible so they can copy files between it and the job directory.
+func (g *Grader) execSpec(stage Stage, sandbox *sandboxSpec) *execSpec {
+	if sandbox != nil && stage != GradeStage {
+		sandbox = sandbox.withReadOnlyPaths(g.graderRoot)
+	}
+	return &execSpec{Sandbox: sandbox, Limits: g.limits[stage]}
+}
+
+func (g *Grader) selectProfile(jobData []byte) (*profile, error) {
+	var job struct {
+		GraderProfile string `json:"grader_profile"`
+	}
+	if err := json.Unmarshal(jobData, &job); err != nil {
+		return nil, err
+	}
+
+	if job.GraderProfile == "" {
+		return &g.profile, nil
+	}
+	p, ok := g.profiles[job.GraderProfile]
+	if !ok {
+		return nil, fmt.Errorf("Unknown grader profile %q", job.GraderProfile)
+	}
+	return p, nil
+}
 
+// NewErrorResult returns the result for a job which could not be graded.
+func NewErrorResult(gid string, status Status, message string) *Result {
 	return &Result{
-		GID: gid,
+		SchemaVersion: ResultSchemaVersion,
+		GID:           gid,
 		Grading: Grading{
-			Score:    score,
-			Feedback: feedback,
+			Status:         status,
+			Message:        message,
+			Feedback:       "",
+			FeedbackFormat: FeedbackText,
 		},
-	}, nil
+	}
 }
 
 func GetGraderRoot(autogradRoot string) string {
 	return filepath.Join(autogradRoot, graderDir)
 }
 
-func runGradeCommand(argv []string, jobDir string, env map[string]string, gid string, timeout time.Duration) (
-	int, []byte) {
+func runGradeCommand(ctx context.Context, argv []string, jobDir string, env map[string]string, gid string,
+	timeout, grace time.Duration, spec *execSpec, output outputOptions, results resultsOptions,
+	rec recorder) Grading {
 	log.WithFields(log.Fields{
 		"gid": gid,
 	}).Infof("Running grade command")
@@ -106,19 +383,86 @@ func runGradeCommand(argv []string, jobDir string, env map[string]string, gid st
 		"gid":  gid,
 		"step": GradeStage,
 	}).Info(strings.Join(argv, " "))
-	out, exitCode, err := execWithTimeout(argv, jobDir, env, timeout)
+	out := newGradeOutput(output, spillName(gid, string(GradeStage)))
+	stdout, stderr := out.writers()
+	exitCode, err := execWithTimeout(ctx, argv, jobDir, env, timeout, grace, spec, stdout, stderr)
+	logOutput(output, log.Fields{"gid": gid, "stage": "grade"}, out.combined)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"gid":   gid,
+			"stage": "grade",
+		}).Warn(err)
+	}
+
+	grading := Grading{
+		Status: StatusSucceeded,
+		Score:  float64(exitCode),
+	}
+	rec.observe(gradeOutputBytes, float64(out.combined.size()))
+	out.fill(&grading)
+	if err != nil {
+		grading.Score = 0
+		if terr, ok := err.(*timeoutError); ok {
+			rec.inc(commandTimeouts, string(GradeStage))
+			grading.Status = StatusTimedOut
+			grading.Message = fmt.Sprintf("Your code timed out after %ds", int(terr.timeout.Seconds()))
+		} else if lerr, ok := err.(*limitError); ok {
+			grading.Status = StatusLimitExceeded
+			grading.Message = fmt.Sprintf("Your code exceeded the %s limit", lerr.resource)
+		} else {
+			grading.Status = StatusGraderCrashed
+			grading.Message = fmt.Sprintf("The grader failed to run: %v", err)
+		}
+	}
+
+	if !results.file || (grading.Status != StatusSucceeded && !results.partial) {
+		logGradeExit(gid, grading, false)
+		return grading
+	}
+
+	res, ok, err := readResults(jobDir)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"gid":   gid,
 			"stage": "grade",
 		}).Warn(err)
+		grading.Score = 0
+		grading.Messages = []string{err.Error()}
+		if grading.Status == StatusSucceeded {
+			grading.Status = StatusGraderCrashed
+			grading.Message = "The grader produced invalid results"
+		}
+	} else if ok {
+		grading.Score = *res.Score
+		grading.MaxPoints = res.MaxPoints
+		grading.TestCases = res.TestCases
+		grading.Messages = res.Messages
+		if res.Feedback != nil {
+			grading.Feedback = res.Feedback
+			grading.FeedbackFormat = FeedbackJSON
+		}
+		if grading.Status != StatusSucceeded {
+			grading.Partial = true
+			grading.Message += "; the score is from the partial results written before it stopped"
+		}
+	} else {
+		grading.Score = 0
+		if grading.Status == StatusSucceeded {
+			grading.Status = StatusGraderCrashed
+			grading.Message = "The grader did not write " + resultsFileName
+		}
 	}
 
+	logGradeExit(gid, grading, ok)
+	return grading
+}
+
+func logGradeExit(gid string, grading Grading, results bool) {
 	log.WithFields(log.Fields{
-		"gid":   gid,
-		"step":  GradeStage,
-		"score": exitCode,
+		"gid":     gid,
+		"step":    GradeStage,
+		"status":  grading.Status,
+		"score":   grading.Score,
+		"results": results,
 	}).Info("Grade command exited")
-
-	return exitCode, out.Bytes()
 }
@@ -0,0 +1,86 @@
+package grader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRunGradeCommandStatus(t *testing.T) {
+	exitCode := resultsOptions{}
+	file := resultsOptions{file: true}
+	partial := resultsOptions{file: true, partial: true}
+
+	tests := []struct {
+		name    string
+		script  string
+		results resultsOptions
+		status  Status
+		score   float64
+		partial bool
+	}{
+		{name: "exit code", script: "exit 7", status: StatusSucceeded, score: 7},
+		{
+			name:   "exit code ignores results",
+			script: `echo '{"score": 100}' > results.json; exit 2`,
+			status: StatusSucceeded,
+			score:  2,
+		},
+		{
+			name:    "results",
+			script:  `echo '{"score": 2.5}' > results.json; exit 7`,
+			results: file,
+			status:  StatusSucceeded,
+			score:   2.5,
+		},
+		{name: "no results", script: "exit 7", results: file, status: StatusGraderCrashed, score: 0},
+		{name: "timeout", script: "sleep 10", results: partial, status: StatusTimedOut, score: 0},
+		{
+			name:    "timeout with results",
+			script:  `echo '{"score": 3}' > results.json; sleep 10`,
+			results: file,
+			status:  StatusTimedOut,
+			score:   0,
+		},
+		{
+			name:    "timeout with partial results",
+			script:  `echo '{"score": 3}' > results.json; sleep 10`,
+			results: partial,
+			status:  StatusTimedOut,
+			score:   3,
+			partial: true,
+		},
+		{
+			name:    "timeout with results in exit code mode",
+			script:  `echo '{"score": 3}' > results.json; sleep 10`,
+			results: exitCode,
+			status:  StatusTimedOut,
+			score:   0,
+		},
+		{name: "invalid results", script: `echo '{}' > results.json`, results: file, status: StatusGraderCrashed, score: 0},
+	}
+
+	for _, tt := range tests {
+		jobDir, err := ioutil.TempDir("", "grader_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(jobDir)
+
+		grading := runGradeCommand(context.Background(), []string{"sh", "-c", tt.script}, jobDir, nil, tt.name,
+			500*time.Millisecond, 0, nil, outputOptions{feedback: FeedbackCombined},
+			tt.results, recorder{})
+
+		if grading.Status != tt.status {
+			t.Errorf("%s: got status %s, want %s", tt.name, grading.Status, tt.status)
+		}
+		if grading.Score != tt.score {
+			t.Errorf("%s: got score %v, want %v", tt.name, grading.Score, tt.score)
+		}
+		if grading.Partial != tt.partial {
+			t.Errorf("%s: got partial %v, want %v", tt.name, grading.Partial, tt.partial)
+		}
+	}
+}
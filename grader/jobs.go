@@ -0,0 +1,80 @@
+package grader
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobStatus describes a job which is being graded.
+type JobStatus struct {
+	GID     string    `json:"gid"`
+	Stage   Stage     `json:"stage"`
+	Started time.Time `json:"started"`
+	Commit  string    `json:"grader_commit,omitempty"`
+}
+
+// runningJobs tracks the jobs being graded by every Grader in the process.
+var runningJobs = newJobRegistry()
+
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[*runningJob]bool
+}
+
+type runningJob struct {
+	registry *jobRegistry
+	status   JobStatus
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[*runningJob]bool)}
+}
+
+// RunningJobs returns the jobs being graded, oldest first.
+func RunningJobs() []JobStatus {
+	return runningJobs.list()
+}
+
+func (r *jobRegistry) start(gid, commit string) *runningJob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job := &runningJob{
+		registry: r,
+		status: JobStatus{
+			GID:     gid,
+			Stage:   SetupStage,
+			Started: time.Now(),
+			Commit:  commit,
+		},
+	}
+	r.jobs[job] = true
+	return job
+}
+
+func (r *jobRegistry) list() []JobStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jobs := make([]JobStatus, 0, len(r.jobs))
+	for job := range r.jobs {
+		jobs = append(jobs, job.status)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Started.Before(jobs[j].Started) })
+	return jobs
+}
+
+func (j *runningJob) setStage(stage Stage) {
+	j.registry.mu.Lock()
+	defer j.registry.mu.Unlock()
+
+	j.status.Stage = stage
+}
+
+func (j *runningJob) finish() {
+	j.registry.mu.Lock()
+	defer j.registry.mu.Unlock()
+
+	delete(j.registry.jobs, j)
+}
@@ -0,0 +1,80 @@
+package grader
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// Limits are resource limits applied to a command. Zero means unlimited.
+// Memory and Processes are enforced by a cgroup for each command if cgroup
+// v2 is available; without it Memory is not supported, and Processes falls
+// back to setrlimit, which counts processes per uid and so only works for
+// sandboxed commands. The rest are applied with setrlimit.
+type Limits struct {
+	AddressSpace int64 `json:"address_space,omitempty"` // bytes
+	CPUTime      int64 `json:"cpu_time,omitempty"`      // seconds
+	Memory       int64 `json:"memory,omitempty"`        // bytes
+	Processes    int64 `json:"processes,omitempty"`
+	FileSize     int64 `json:"file_size,omitempty"` // bytes
+	OpenFiles    int64 `json:"open_files,omitempty"`
+}
+
+// limitError is returned by execWithTimeout when a command was killed for
+// exceeding a resource limit.
+type limitError struct {
+	resource string
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("Command exceeded %s limit", e.resource)
+}
+
+// SetLimits sets the resource limits for commands run in stage. It returns
+// an error if the limits cannot be enforced, so EnableSandbox must be called
+// first.
+func (g *Grader) SetLimits(stage Stage, limits Limits) error {
+	if err := limits.check(g.sandbox != nil && stage != InitStage); err != nil {
+		return fmt.Errorf("%s limits: %v", stage, err)
+	}
+	g.limits[stage] = &limits
+	return nil
+}
+
+// check returns an error if the limits cannot be enforced for commands which
+// are sandboxed or not.
+func (l Limits) check(sandboxed bool) error {
+	if l.Memory > 0 && !cgroupsAvailable() {
+		return errors.New("the memory limit needs cgroup v2 with the memory controller")
+	}
+	if l.Processes > 0 && !sandboxed && !cgroupsAvailable() {
+		// RLIMIT_NPROC is counted per uid and not enforced for root.
+		return errors.New("the processes limit needs cgroup v2 with the pids controller, or the sandbox")
+	}
+	return nil
+}
+
+// violation returns a limitError if a command with these limits which exited
+// with status was killed for exceeding one of them.
+func (l *Limits) violation(status syscall.WaitStatus, rusage *syscall.Rusage) error {
+	if l == nil || !status.Signaled() {
+		return nil
+	}
+
+	switch status.Signal() {
+	case syscall.SIGXCPU:
+		return &limitError{resource: "CPU time"}
+	case syscall.SIGXFSZ:
+		return &limitError{resource: "file size"}
+	case syscall.SIGKILL:
+		// SIGKILL at the hard CPU limit, if SIGXCPU was ignored
+		if l.CPUTime > 0 && rusage != nil {
+			used := time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano())
+			if used >= time.Duration(l.CPUTime)*time.Second {
+				return &limitError{resource: "CPU time"}
+			}
+		}
+	}
+	return nil
+}
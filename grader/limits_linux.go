@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package grader
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const rlimitNproc = 6 // RLIMIT_NPROC, missing from package syscall
+
+// apply sets the limits on the current process, to be inherited by the
+// command it execs.
+func (l *Limits) apply() error {
+	limits := []struct {
+		resource int
+		name     string
+		value    int64
+	}{
+		{syscall.RLIMIT_AS, "address space", l.AddressSpace},
+		{syscall.RLIMIT_CPU, "CPU time", l.CPUTime},
+		{rlimitNproc, "processes", l.Processes},
+		{syscall.RLIMIT_FSIZE, "file size", l.FileSize},
+		{syscall.RLIMIT_NOFILE, "open files", l.OpenFiles},
+	}
+
+	for _, limit := range limits {
+		if limit.value <= 0 {
+			continue
+		}
+		rlimit := &syscall.Rlimit{Cur: uint64(limit.value), Max: uint64(limit.value)}
+		if limit.resource == syscall.RLIMIT_CPU {
+			// SIGXCPU at the soft limit, SIGKILL a second later
+			rlimit.Max++
+		}
+		if err := syscall.Setrlimit(limit.resource, rlimit); err != nil {
+			return fmt.Errorf("setting %s limit: %v", limit.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package grader
+
+import (
+	"github.com/PrairieLearn/autograd/metrics"
+)
+
+var (
+	stageDuration = metrics.NewHistogram("autograd_stage_duration_seconds",
+		"Time taken to run the commands of a grading stage.",
+		metrics.ExponentialBuckets(0.1, 2, 14), "stage")
+	commandTimeouts = metrics.NewCounter("autograd_command_timeouts_total",
+		"Commands killed for running past their timeout.", "stage")
+	stageFailures = metrics.NewCounter("autograd_stage_failures_total",
+		"Setup and cleanup stages which failed.", "stage")
+	gradingResults = metrics.NewCounter("autograd_grading_results_total",
+		"Grading results, by status.", "status")
+	gradingScore = metrics.NewHistogram("autograd_grading_score_ratio",
+		"Scores given by grade commands as a fraction of max_points, for results with max_points.",
+		[]float64{0, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 1})
+	gradeOutputBytes = metrics.NewHistogram("autograd_grade_output_bytes",
+		"Bytes written by grade commands to stdout and stderr, before truncation.",
+		metrics.ExponentialBuckets(1024, 4, 10))
+)
+
+// recorder records the metrics and running job status of the jobs a Grader
+// grades. Its zero value records neither, so that grading self-test fixtures
+// does not show up as real jobs.
+type recorder struct {
+	jobs *jobRegistry
+}
+
+// defaultRecorder records to the process's metrics and runningJobs.
+var defaultRecorder = recorder{jobs: runningJobs}
+
+func (r recorder) enabled() bool {
+	return r.jobs != nil
+}
+
+// startJob registers a job as running. Without a registry the job is tracked
+// by one of its own, which nothing lists.
+func (r recorder) startJob(gid, commit string) *runningJob {
+	if r.jobs == nil {
+		return newJobRegistry().start(gid, commit)
+	}
+	return r.jobs.start(gid, commit)
+}
+
+func (r recorder) inc(c *metrics.Counter, labelValues ...string) {
+	if r.enabled() {
+		c.Inc(labelValues...)
+	}
+}
+
+func (r recorder) observe(h *metrics.Histogram, v float64, labelValues ...string) {
+	if r.enabled() {
+		h.Observe(v, labelValues...)
+	}
+}
@@ -0,0 +1,425 @@
+package grader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultOutputHeadBytes = 512 * 1024
+	defaultOutputTailBytes = 512 * 1024
+
+	spillTimeFormat = "20060102T150405.000000000Z"
+)
+
+// OutputLimit bounds how much of a command's output is kept in memory. The
+// first HeadBytes and last TailBytes are kept; if SpillDir is set, the full
+// output of a command which exceeds the limit is also written to a file
+// there.
+type OutputLimit struct {
+	HeadBytes int
+	TailBytes int
+	SpillDir  string
+}
+
+// FeedbackStream selects which output of the grade command is shown to
+// students as feedback.
+type FeedbackStream string
+
+const (
+	FeedbackCombined FeedbackStream = "combined"
+	FeedbackStdout   FeedbackStream = "stdout"
+	FeedbackStderr   FeedbackStream = "stderr"
+	FeedbackNone     FeedbackStream = "none"
+)
+
+// OutputChunk is a piece of the grade command's output with the time it was
+// written.
+type OutputChunk struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Data   string    `json:"data"`
+}
+
+type outputOptions struct {
+	limits     map[Stage]OutputLimit // defaultOutputLimit for stages not set
+	feedback   FeedbackStream
+	streams    map[FeedbackStream]bool // stdout and stderr streams the result carries
+	timestamps bool
+	log        io.Writer // receives the kept output of each command, if set
+}
+
+var defaultOutputLimit = OutputLimit{
+	HeadBytes: defaultOutputHeadBytes,
+	TailBytes: defaultOutputTailBytes,
+}
+
+func (o *outputOptions) limit(stage Stage) OutputLimit {
+	if limit, ok := o.limits[stage]; ok {
+		return limit
+	}
+	return defaultOutputLimit
+}
+
+// SetOutputLimit sets how much of the output of each command run in stage is
+// kept, in memory and in the output log. For the grade command, it applies
+// to each stream.
+func (g *Grader) SetOutputLimit(stage Stage, limit OutputLimit) {
+	if limit.HeadBytes <= 0 {
+		limit.HeadBytes = defaultOutputHeadBytes
+	}
+	if limit.TailBytes <= 0 {
+		limit.TailBytes = defaultOutputTailBytes
+	}
+	g.output.limits[stage] = limit
+}
+
+// SetOutputLog sets where the kept output of each command is written once
+// it exits, os.Stdout by default.
+func (g *Grader) SetOutputLog(w io.Writer) {
+	g.output.log = w
+}
+
+// SetFeedback sets which output of the grade command is shown to students,
+// which of its stdout and stderr streams the result also carries separately,
+// and whether the result includes the output as timestamped chunks.
+func (g *Grader) SetFeedback(feedback FeedbackStream, streams []FeedbackStream, timestamps bool) error {
+	switch feedback {
+	case "":
+		feedback = FeedbackCombined
+	case FeedbackCombined, FeedbackStdout, FeedbackStderr, FeedbackNone:
+	default:
+		return fmt.Errorf("Invalid feedback %q, must be combined, stdout, stderr or none", feedback)
+	}
+
+	selected := make(map[FeedbackStream]bool)
+	for _, stream := range streams {
+		if stream != FeedbackStdout && stream != FeedbackStderr {
+			return fmt.Errorf("Invalid output stream %q, must be stdout or stderr", stream)
+		}
+		selected[stream] = true
+	}
+
+	g.output.feedback = feedback
+	g.output.streams = selected
+	g.output.timestamps = timestamps
+	return nil
+}
+
+// gradeOutput captures the grade command's output interleaved, which is
+// logged and spilled to disk, and its stdout and stderr separately if the
+// result needs them.
+type gradeOutput struct {
+	opts     outputOptions
+	stdout   *cappedBuffer // nil unless needed
+	stderr   *cappedBuffer // nil unless needed
+	combined *cappedBuffer
+	chunks   *chunkRecorder // nil unless timestamps are enabled
+}
+
+func newGradeOutput(opts outputOptions, spillName string) *gradeOutput {
+	limit := opts.limit(GradeStage)
+	streamLimit := OutputLimit{HeadBytes: limit.HeadBytes, TailBytes: limit.TailBytes}
+	o := &gradeOutput{
+		opts:     opts,
+		combined: newCappedBuffer(limit, spillName),
+	}
+	if opts.feedback == FeedbackStdout || opts.streams[FeedbackStdout] {
+		o.stdout = newCappedBuffer(streamLimit, "")
+	}
+	if opts.feedback == FeedbackStderr || opts.streams[FeedbackStderr] {
+		o.stderr = newCappedBuffer(streamLimit, "")
+	}
+	if opts.timestamps {
+		o.chunks = &chunkRecorder{maxBytes: int64(limit.HeadBytes + limit.TailBytes)}
+	}
+	return o
+}
+
+func (o *gradeOutput) writers() (stdout, stderr io.Writer) {
+	stdout, stderr = o.combined, o.combined
+	if o.stdout != nil {
+		stdout = io.MultiWriter(o.stdout, stdout)
+	}
+	if o.stderr != nil {
+		stderr = io.MultiWriter(o.stderr, stderr)
+	}
+	if o.chunks != nil {
+		stdout = io.MultiWriter(stdout, &chunkWriter{o.chunks, "stdout"})
+		stderr = io.MultiWriter(stderr, &chunkWriter{o.chunks, "stderr"})
+	}
+	return stdout, stderr
+}
+
+// fill sets the feedback and output of grading. Each stream is carried at
+// most once besides the feedback, as results with every stream in full would
+// be several times the size of the output.
+func (o *gradeOutput) fill(grading *Grading) {
+	if o.opts.streams[FeedbackStdout] {
+		grading.Stdout = sanitizeUTF8(o.stdout.Bytes())
+	}
+	if o.opts.streams[FeedbackStderr] {
+		grading.Stderr = sanitizeUTF8(o.stderr.Bytes())
+	}
+	if o.chunks != nil {
+		grading.Output = o.chunks.result()
+	}
+
+	grading.FeedbackFormat = FeedbackText
+	switch o.opts.feedback {
+	case FeedbackStdout:
+		grading.Feedback = sanitizeUTF8(o.stdout.Bytes())
+	case FeedbackStderr:
+		grading.Feedback = sanitizeUTF8(o.stderr.Bytes())
+	case FeedbackNone:
+		grading.Feedback = ""
+	default:
+		grading.Feedback = sanitizeUTF8(o.combined.Bytes())
+	}
+}
+
+// spillName returns the name of the file a command's full output is spilled
+// to. It includes the time, so a regraded job does not overwrite the output
+// of its earlier attempts.
+func spillName(gid, command string) string {
+	if gid == "" {
+		return fmt.Sprintf("%s-%s.log", command, time.Now().UTC().Format(spillTimeFormat))
+	}
+	return fmt.Sprintf("%s-%s-%s.log", gid, command, time.Now().UTC().Format(spillTimeFormat))
+}
+
+// logOutput writes the kept output of a command to the output log, and logs
+// where its full output was spilled if it was truncated.
+func logOutput(opts outputOptions, fields log.Fields, out *cappedBuffer) {
+	if opts.log != nil {
+		opts.log.Write(out.Bytes())
+	}
+
+	path, err := out.Close()
+	if omitted := out.truncated(); omitted > 0 {
+		fields["omitted"] = omitted
+		if err != nil {
+			log.WithFields(fields).Warnf("Error saving full output: %v", err)
+		} else if path != "" {
+			fields["path"] = path
+		}
+		log.WithFields(fields).Info("Output truncated")
+	}
+}
+
+// sanitizeUTF8 converts output to a string, replacing invalid UTF-8 with
+// U+FFFD. Output may be cut in the middle of a character where it was
+// truncated or split into chunks.
+func sanitizeUTF8(b []byte) string {
+	return strings.ToValidUTF8(string(b), "\uFFFD")
+}
+
+// chunkRecorder records output as timestamped chunks, up to maxBytes.
+type chunkRecorder struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	omitted  int64
+	chunks   []OutputChunk
+}
+
+type chunkWriter struct {
+	recorder *chunkRecorder
+	stream   string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	r := w.recorder
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := p
+	if room := r.maxBytes - r.bytes; int64(len(data)) > room {
+		r.omitted += int64(len(data)) - room
+		data = data[:room]
+	}
+	if len(data) > 0 {
+		r.chunks = append(r.chunks, OutputChunk{
+			Time:   time.Now(),
+			Stream: w.stream,
+			Data:   sanitizeUTF8(data),
+		})
+		r.bytes += int64(len(data))
+	}
+	return len(p), nil
+}
+
+func (r *chunkRecorder) result() []OutputChunk {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chunks := r.chunks
+	if r.omitted > 0 {
+		chunks = append(chunks, OutputChunk{
+			Time:   time.Now(),
+			Stream: "autograd",
+			Data:   fmt.Sprintf("... output truncated (%d bytes omitted) ...", r.omitted),
+		})
+	}
+	return chunks
+}
+
+// cappedBuffer is an io.Writer which keeps the head and tail of what is
+// written to it. It is safe for concurrent use.
+type cappedBuffer struct {
+	mu        sync.Mutex
+	limit     OutputLimit
+	spillPath string
+
+	head  []byte
+	tail  []byte // ring buffer once full
+	start int    // index of the oldest byte in tail
+	total int64
+
+	spill    *os.File
+	spillErr error
+}
+
+func newCappedBuffer(limit OutputLimit, spillName string) *cappedBuffer {
+	b := &cappedBuffer{limit: limit}
+	if limit.SpillDir != "" {
+		b.spillPath = filepath.Join(limit.SpillDir, sanitizeFileName(spillName))
+	}
+	return b
+}
+
+// sanitizeFileName replaces characters which are unsafe in a file name, as
+// spill file names include the job's gid.
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+
+	if b.spill == nil && b.spillPath != "" && b.spillErr == nil &&
+		b.total+int64(n) > int64(b.limit.HeadBytes+b.limit.TailBytes) {
+		b.startSpill()
+	}
+	if b.spill != nil {
+		if _, err := b.spill.Write(p); err != nil {
+			b.spillErr = err
+			b.spill.Close()
+			b.spill = nil
+		}
+	}
+	b.total += int64(n)
+
+	if room := b.limit.HeadBytes - len(b.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.head = append(b.head, p[:room]...)
+		p = p[room:]
+	}
+
+	if len(p) >= b.limit.TailBytes {
+		b.tail = append(b.tail[:0], p[len(p)-b.limit.TailBytes:]...)
+		b.start = 0
+		return n, nil
+	}
+	for len(p) > 0 {
+		if len(b.tail) < b.limit.TailBytes {
+			room := b.limit.TailBytes - len(b.tail)
+			if room > len(p) {
+				room = len(p)
+			}
+			b.tail = append(b.tail, p[:room]...)
+			p = p[room:]
+			continue
+		}
+		copied := copy(b.tail[b.start:], p)
+		p = p[copied:]
+		b.start = (b.start + copied) % len(b.tail)
+	}
+	return n, nil
+}
+
+// startSpill writes everything kept so far, which is all of the output as
+// it has not been truncated yet, to the spill file.
+func (b *cappedBuffer) startSpill() {
+	if err := os.MkdirAll(b.limit.SpillDir, 0755); err != nil {
+		b.spillErr = err
+		return
+	}
+	b.spill, b.spillErr = os.Create(b.spillPath)
+	if b.spillErr != nil {
+		return
+	}
+	if _, err := b.spill.Write(b.head); err == nil {
+		_, err = b.spill.Write(b.orderedTail())
+		b.spillErr = err
+	}
+}
+
+func (b *cappedBuffer) orderedTail() []byte {
+	return append(append([]byte{}, b.tail[b.start:]...), b.tail[:b.start]...)
+}
+
+// size returns the number of bytes written to the buffer.
+func (b *cappedBuffer) size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.total
+}
+
+// truncated returns the number of bytes dropped from the middle of the
+// output.
+func (b *cappedBuffer) truncated() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.total - int64(len(b.head)+len(b.tail))
+}
+
+// Bytes returns the kept output, with a marker where output was dropped.
+func (b *cappedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := append([]byte{}, b.head...)
+	if omitted := b.total - int64(len(b.head)+len(b.tail)); omitted > 0 {
+		marker := fmt.Sprintf("\n\n... output truncated (%d bytes omitted) ...\n\n", omitted)
+		out = append(out, marker...)
+	}
+	return append(out, b.orderedTail()...)
+}
+
+// Close closes the spill file, returning its path if the full output was
+// written to it.
+func (b *cappedBuffer) Close() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.spill == nil {
+		return "", b.spillErr
+	}
+	if err := b.spill.Close(); err != nil {
+		return "", err
+	}
+	if b.spillErr != nil {
+		return "", b.spillErr
+	}
+	return b.spillPath, nil
+}
@@ -0,0 +1,213 @@
+package grader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCappedBuffer(t *testing.T) {
+	tests := []struct {
+		name      string
+		head      int
+		tail      int
+		writes    []string
+		want      string
+		truncated int64
+	}{
+		{name: "empty", head: 4, tail: 4, want: ""},
+		{name: "fits", head: 4, tail: 4, writes: []string{"abc", "def"}, want: "abcdef"},
+		{name: "exactly full", head: 4, tail: 4, writes: []string{"abcdefgh"}, want: "abcdefgh"},
+		{
+			name:      "one big write",
+			head:      3,
+			tail:      3,
+			writes:    []string{"abcdefghij"},
+			want:      "abc" + truncationMarker(4) + "hij",
+			truncated: 4,
+		},
+		{
+			name:      "many small writes",
+			head:      2,
+			tail:      3,
+			writes:    []string{"a", "b", "c", "d", "e", "f", "g", "h"},
+			want:      "ab" + truncationMarker(3) + "fgh",
+			truncated: 3,
+		},
+		{
+			name:      "wraps tail",
+			head:      2,
+			tail:      4,
+			writes:    []string{"ab", "cde", "fgh", "ij"},
+			want:      "ab" + truncationMarker(4) + "ghij",
+			truncated: 4,
+		},
+		{
+			name:      "write larger than tail after wrap",
+			head:      1,
+			tail:      3,
+			writes:    []string{"abcde", "fghijk"},
+			want:      "a" + truncationMarker(7) + "ijk",
+			truncated: 7,
+		},
+	}
+
+	for _, tt := range tests {
+		b := newCappedBuffer(OutputLimit{HeadBytes: tt.head, TailBytes: tt.tail}, "")
+		var total int64
+		for _, w := range tt.writes {
+			if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+				t.Errorf("%s: Write(%q) = %d, %v", tt.name, w, n, err)
+			}
+			total += int64(len(w))
+		}
+
+		if got := string(b.Bytes()); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if got := b.truncated(); got != tt.truncated {
+			t.Errorf("%s: got %d bytes truncated, want %d", tt.name, got, tt.truncated)
+		}
+		if got := b.size(); got != total {
+			t.Errorf("%s: got size %d, want %d", tt.name, got, total)
+		}
+	}
+}
+
+func truncationMarker(omitted int) string {
+	return fmt.Sprintf("\n\n... output truncated (%d bytes omitted) ...\n\n", omitted)
+}
+
+func TestCappedBufferSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		writes []string
+		spill  bool
+	}{
+		{name: "under limit", writes: []string{"abc", "def"}, spill: false},
+		{name: "over limit", writes: []string{"abc", "defgh", "ijklmnop"}, spill: true},
+	}
+
+	for _, tt := range tests {
+		b := newCappedBuffer(OutputLimit{HeadBytes: 4, TailBytes: 4, SpillDir: dir}, tt.name+".log")
+		for _, w := range tt.writes {
+			b.Write([]byte(w))
+		}
+
+		path, err := b.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.spill {
+			if path != "" {
+				t.Errorf("%s: spilled to %s under the limit", tt.name, path)
+			}
+			continue
+		}
+		if want := filepath.Join(dir, "over_limit.log"); path != want {
+			t.Errorf("%s: got spill path %s, want %s", tt.name, path, want)
+		}
+		full, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if want := strings.Join(tt.writes, ""); string(full) != want {
+			t.Errorf("%s: spilled %q, want %q", tt.name, full, want)
+		}
+	}
+}
+
+func TestSpillNameIsUnique(t *testing.T) {
+	first := spillName("g1", "grade")
+	second := spillName("g1", "grade")
+	if first == second {
+		t.Errorf("spill names for the same command are both %s", first)
+	}
+	if !strings.HasPrefix(first, "g1-grade-") {
+		t.Errorf("got spill name %s, want it to start with the gid and command", first)
+	}
+}
+
+func TestGradeOutputStreams(t *testing.T) {
+	tests := []struct {
+		name     string
+		feedback FeedbackStream
+		streams  []FeedbackStream
+		want     Grading
+	}{
+		{name: "combined", feedback: FeedbackCombined, want: Grading{Feedback: "out err "}},
+		{name: "stdout", feedback: FeedbackStdout, want: Grading{Feedback: "out "}},
+		{name: "stderr", feedback: FeedbackStderr, want: Grading{Feedback: "err "}},
+		{name: "none", feedback: FeedbackNone, want: Grading{Feedback: ""}},
+		{
+			name:     "none with streams",
+			feedback: FeedbackNone,
+			streams:  []FeedbackStream{FeedbackStdout, FeedbackStderr},
+			want:     Grading{Feedback: "", Stdout: "out ", Stderr: "err "},
+		},
+		{
+			name:     "stdout with stderr stream",
+			feedback: FeedbackStdout,
+			streams:  []FeedbackStream{FeedbackStderr},
+			want:     Grading{Feedback: "out ", Stderr: "err "},
+		},
+	}
+
+	for _, tt := range tests {
+		g := New("", "", nil, nil, nil, 0)
+		if err := g.SetFeedback(tt.feedback, tt.streams, false); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		out := newGradeOutput(g.output, "")
+		stdout, stderr := out.writers()
+		stdout.Write([]byte("out "))
+		stderr.Write([]byte("err "))
+
+		var grading Grading
+		out.fill(&grading)
+		if grading.Feedback != tt.want.Feedback || grading.Stdout != tt.want.Stdout ||
+			grading.Stderr != tt.want.Stderr {
+			t.Errorf("%s: got feedback %q, stdout %q, stderr %q, want %q, %q, %q", tt.name,
+				grading.Feedback, grading.Stdout, grading.Stderr, tt.want.Feedback, tt.want.Stdout, tt.want.Stderr)
+		}
+	}
+}
+
+func TestSetFeedbackRejectsInvalidStreams(t *testing.T) {
+	g := New("", "", nil, nil, nil, 0)
+	if err := g.SetFeedback("both", nil, false); err == nil {
+		t.Error("SetFeedback accepted feedback \"both\"")
+	}
+	if err := g.SetFeedback(FeedbackCombined, []FeedbackStream{FeedbackCombined}, false); err == nil {
+		t.Error("SetFeedback accepted stream \"combined\"")
+	}
+}
+
+func TestSanitizeUTF8(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: ""},
+		{in: "plain ascii", want: "plain ascii"},
+		{in: "héllo, 世界", want: "héllo, 世界"},
+		{in: "bad \xff byte", want: "bad � byte"},
+		{in: "cut \xe4\xb8", want: "cut �"},
+		{in: "\xff\xfe\xfd", want: "�"},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeUTF8([]byte(tt.in)); got != tt.want {
+			t.Errorf("sanitizeUTF8(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
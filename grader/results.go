@@ -0,0 +1,102 @@
+package grader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	resultsFileName = "results.json"
+)
+
+// gradeResults is the format of the results.json file a grade command may
+// write to $AUTOGRAD_JOB_DIR in place of returning the score as its exit code.
+type gradeResults struct {
+	Score     *float64   `json:"score"`
+	MaxPoints float64    `json:"max_points"`
+	TestCases []TestCase `json:"test_cases"`
+	Messages  []string   `json:"messages"`
+	// Feedback replaces the grade command's output as the feedback shown
+	// to students. It must be a JSON object.
+	Feedback json.RawMessage `json:"feedback"`
+}
+
+// readResults reads and validates results.json from the job directory. The
+// returned bool is false if the grade command did not write a results file.
+func readResults(jobDir string) (*gradeResults, bool, error) {
+	path := filepath.Join(jobDir, resultsFileName)
+
+	// The job directory is writable by the grade command, which must not
+	// be able to make autograd read other files through a symlink.
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, true, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, true, fmt.Errorf("Invalid %s: not a regular file", resultsFileName)
+	}
+
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, true, err
+	}
+
+	var results gradeResults
+	if err := json.Unmarshal(file, &results); err != nil {
+		return nil, true, fmt.Errorf("Invalid %s: %v", resultsFileName, err)
+	}
+	// "feedback": null decodes as the raw JSON null rather than nil.
+	if string(results.Feedback) == "null" {
+		results.Feedback = nil
+	}
+	if err := results.validate(); err != nil {
+		return nil, true, fmt.Errorf("Invalid %s: %v", resultsFileName, err)
+	}
+
+	return &results, true, nil
+}
+
+func (r *gradeResults) validate() error {
+	if r.Score == nil {
+		return fmt.Errorf("missing score")
+	}
+	if r.MaxPoints < 0 {
+		return fmt.Errorf("max_points must be non-negative, got %v", r.MaxPoints)
+	}
+	if err := checkPoints("score", *r.Score, r.MaxPoints); err != nil {
+		return err
+	}
+	if r.Feedback != nil && !isJSONObject(r.Feedback) {
+		return fmt.Errorf("feedback must be a JSON object")
+	}
+	for i, tc := range r.TestCases {
+		if tc.MaxPoints < 0 {
+			return fmt.Errorf("test_cases[%d]: max_points must be non-negative, got %v", i, tc.MaxPoints)
+		}
+		if err := checkPoints(fmt.Sprintf("test_cases[%d]: points", i), tc.Points, tc.MaxPoints); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkPoints(name string, points, maxPoints float64) error {
+	if points < 0 {
+		return fmt.Errorf("%s must be non-negative, got %v", name, points)
+	}
+	if maxPoints > 0 && points > maxPoints {
+		return fmt.Errorf("%s %v exceeds max_points %v", name, points, maxPoints)
+	}
+	return nil
+}
+
+func isJSONObject(raw json.RawMessage) bool {
+	var obj map[string]interface{}
+	return json.Unmarshal(raw, &obj) == nil && obj != nil
+}
@@ -0,0 +1,101 @@
+package grader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadResults(t *testing.T) {
+	tests := []struct {
+		name    string
+		results string // not written if empty
+		ok      bool
+		score   float64
+		err     string
+	}{
+		{name: "missing", ok: false},
+		{name: "score only", results: `{"score": 7.5}`, ok: true, score: 7.5},
+		{name: "with max_points", results: `{"score": 10, "max_points": 10}`, ok: true, score: 10},
+		{
+			name: "test cases",
+			results: `{"score": 5, "max_points": 10, "test_cases": [
+				{"name": "a", "points": 5, "max_points": 5},
+				{"name": "b", "points": 0, "max_points": 5, "message": "wrong"}]}`,
+			ok:    true,
+			score: 5,
+		},
+		{name: "feedback object", results: `{"score": 1, "feedback": {"summary": "ok"}}`, ok: true, score: 1},
+		{name: "feedback null", results: `{"score": 1, "feedback": null}`, ok: true, score: 1},
+		{name: "not JSON", results: `score: 1`, ok: true, err: "Invalid results.json"},
+		{name: "missing score", results: `{"max_points": 10}`, ok: true, err: "missing score"},
+		{name: "negative score", results: `{"score": -1}`, ok: true, err: "score must be non-negative"},
+		{name: "score above max", results: `{"score": 11, "max_points": 10}`, ok: true, err: "exceeds max_points"},
+		{name: "negative max_points", results: `{"score": 0, "max_points": -1}`, ok: true,
+			err: "max_points must be non-negative"},
+		{name: "feedback not an object", results: `{"score": 1, "feedback": "text"}`, ok: true,
+			err: "feedback must be a JSON object"},
+		{
+			name:    "test case above max",
+			results: `{"score": 1, "test_cases": [{"name": "a", "points": 2, "max_points": 1}]}`,
+			ok:      true,
+			err:     "test_cases[0]: points 2 exceeds max_points 1",
+		},
+	}
+
+	for _, tt := range tests {
+		jobDir, err := ioutil.TempDir("", "results_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(jobDir)
+		if tt.results != "" {
+			if err := ioutil.WriteFile(filepath.Join(jobDir, resultsFileName), []byte(tt.results), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		results, ok, err := readResults(jobDir)
+		if ok != tt.ok {
+			t.Errorf("%s: got ok %v, want %v", tt.name, ok, tt.ok)
+		}
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if ok && *results.Score != tt.score {
+			t.Errorf("%s: got score %v, want %v", tt.name, *results.Score, tt.score)
+		}
+		if ok && string(results.Feedback) == "null" {
+			t.Errorf("%s: null feedback was not treated as absent", tt.name)
+		}
+	}
+}
+
+func TestReadResultsRejectsSymlink(t *testing.T) {
+	jobDir, err := ioutil.TempDir("", "results_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(jobDir)
+
+	target := filepath.Join(jobDir, "secret.json")
+	if err := ioutil.WriteFile(target, []byte(`{"score": 100}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(jobDir, resultsFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := readResults(jobDir); err == nil || !strings.Contains(err.Error(), "not a regular file") {
+		t.Errorf("got error %v, want not a regular file", err)
+	}
+}
@@ -0,0 +1,126 @@
+package grader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	sandboxPrefix = "sandbox_"
+
+	defaultSandboxUIDBase = 20000
+)
+
+var defaultSandboxReadOnlyPaths = []string{"/bin", "/etc", "/lib", "/lib64", "/usr"}
+
+// sandboxConfig describes how setup, grade and cleanup commands are
+// sandboxed. Each job runs as its own unprivileged uid in new mount, pid and
+// network namespaces, with only readOnlyPaths and the job directory visible.
+type sandboxConfig struct {
+	readOnlyPaths []string
+	allowNetwork  bool
+	uidBase       int
+}
+
+// sandboxSpec is the sandbox for one job, set up by the exec init process.
+type sandboxSpec struct {
+	Root          string   `json:"root"`
+	JobDir        string   `json:"job_dir"`
+	ReadOnlyPaths []string `json:"read_only_paths"`
+	AllowNetwork  bool     `json:"allow_network"`
+	UID           int      `json:"uid"`
+}
+
+// sandboxUIDs hands out a distinct uid to each running sandboxed job, across
+// every Grader in the process.
+var sandboxUIDs = &uidPool{inUse: make(map[int]bool)}
+
+type uidPool struct {
+	mu    sync.Mutex
+	inUse map[int]bool
+}
+
+func (p *uidPool) acquire(base int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	uid := base
+	for p.inUse[uid] {
+		uid++
+	}
+	p.inUse[uid] = true
+	return uid
+}
+
+func (p *uidPool) release(uid int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.inUse, uid)
+}
+
+// EnableSandbox makes the setup, grade and cleanup commands of every profile
+// run in a sandbox. readOnlyPaths may reference the job environment, e.g.
+// $AUTOGRAD_GRADER_ROOT/public.
+func (g *Grader) EnableSandbox(readOnlyPaths []string, allowNetwork bool, uidBase int) {
+	if len(readOnlyPaths) == 0 {
+		readOnlyPaths = defaultSandboxReadOnlyPaths
+	}
+	if uidBase <= 0 {
+		uidBase = defaultSandboxUIDBase
+	}
+	g.sandbox = &sandboxConfig{
+		readOnlyPaths: readOnlyPaths,
+		allowNetwork:  allowNetwork,
+		uidBase:       uidBase,
+	}
+}
+
+// newSandboxSpec prepares a sandbox for a job, handing the job directory over
+// to the job's uid. The returned function releases the sandbox.
+func (c *sandboxConfig) newSandboxSpec(autogradRoot, jobDir string, env map[string]string) (
+	*sandboxSpec, func(), error) {
+	uid := sandboxUIDs.acquire(c.uidBase)
+
+	root, err := ioutil.TempDir(autogradRoot, sandboxPrefix)
+	if err != nil {
+		sandboxUIDs.release(uid)
+		return nil, nil, err
+	}
+	release := func() {
+		os.RemoveAll(root)
+		sandboxUIDs.release(uid)
+	}
+
+	if err := chownAll(jobDir, uid); err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	return &sandboxSpec{
+		Root:          root,
+		JobDir:        jobDir,
+		ReadOnlyPaths: expandArgs(c.readOnlyPaths, env),
+		AllowNetwork:  c.allowNetwork,
+		UID:           uid,
+	}, release, nil
+}
+
+// withReadOnlyPaths returns a copy of spec with paths also mounted
+// read-only.
+func (spec *sandboxSpec) withReadOnlyPaths(paths ...string) *sandboxSpec {
+	s := *spec
+	s.ReadOnlyPaths = append(append([]string(nil), spec.ReadOnlyPaths...), paths...)
+	return &s
+}
+
+func chownAll(dir string, uid int) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, uid)
+	})
+}
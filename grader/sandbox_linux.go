@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+package grader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// sandboxDevices are bind mounted into every sandbox.
+var sandboxDevices = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+// enter builds the sandbox filesystem, chroots into it and drops to the
+// job's uid. The working directory is kept, so it must be visible in the
+// sandbox.
+func (spec *sandboxSpec) enter() error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", spec.Root, "tmpfs", 0, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting sandbox root: %v", err)
+	}
+
+	for _, path := range spec.ReadOnlyPaths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := bindMount(path, filepath.Join(spec.Root, path), true); err != nil {
+			return err
+		}
+	}
+	for _, path := range sandboxDevices {
+		if err := bindMount(path, filepath.Join(spec.Root, path), false); err != nil {
+			return err
+		}
+	}
+	if err := bindMount(spec.JobDir, filepath.Join(spec.Root, spec.JobDir), false); err != nil {
+		return err
+	}
+
+	proc := filepath.Join(spec.Root, "proc")
+	if err := os.MkdirAll(proc, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %v", err)
+	}
+
+	if err := syscall.Chroot(spec.Root); err != nil {
+		return fmt.Errorf("chroot: %v", err)
+	}
+	if err := syscall.Chdir(dir); err != nil {
+		return fmt.Errorf("chdir: %v", err)
+	}
+
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(spec.UID); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(spec.UID); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	return nil
+}
+
+// bindMount mounts source at target, creating the mount point.
+func bindMount(source, target string, readOnly bool) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			err = ioutil.WriteFile(target, nil, 0644)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mounting %s: %v", source, err)
+	}
+	if readOnly {
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_REC)
+		if err := syscall.Mount("", target, "", flags, ""); err != nil {
+			return fmt.Errorf("remounting %s read-only: %v", source, err)
+		}
+	}
+	return nil
+}
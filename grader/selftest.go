@@ -0,0 +1,69 @@
+package grader
+
+import (
+	"context"
+	"fmt"
+)
+
+// Fixture is a job with a known expected result, used to check that a
+// grader works before it grades real jobs.
+type Fixture struct {
+	Name     string
+	JobData  []byte
+	Status   Status   // expected status; any status is accepted if empty
+	MinScore *float64 // nil means no lower bound
+	MaxScore *float64 // nil means no upper bound
+}
+
+// FixtureResult is the outcome of grading a Fixture. Failures lists how the
+// result differed from what the fixture expected.
+type FixtureResult struct {
+	Name     string
+	Result   *Result
+	Failures []string
+}
+
+func (r *FixtureResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// AddFixture adds a fixture to be graded by SelfTest.
+func (g *Grader) AddFixture(f Fixture) {
+	g.fixtures = append(g.fixtures, f)
+}
+
+// SelfTest grades each fixture in turn and checks its result. Fixtures are
+// graded like jobs, but are left out of metrics and RunningJobs.
+func (g *Grader) SelfTest(ctx context.Context) []FixtureResult {
+	untracked := *g
+	untracked.recorder = recorder{}
+
+	results := make([]FixtureResult, len(g.fixtures))
+	for i, f := range g.fixtures {
+		results[i] = untracked.runFixture(ctx, f)
+	}
+	return results
+}
+
+func (g *Grader) runFixture(ctx context.Context, f Fixture) FixtureResult {
+	r := FixtureResult{Name: f.Name}
+
+	result, err := g.Grade(ctx, "selftest-"+f.Name, f.JobData)
+	if err != nil {
+		r.Failures = append(r.Failures, fmt.Sprintf("grading failed: %v", err))
+		return r
+	}
+	r.Result = result
+
+	grading := result.Grading
+	if f.Status != "" && grading.Status != f.Status {
+		r.Failures = append(r.Failures, fmt.Sprintf("status is %s, expected %s", grading.Status, f.Status))
+	}
+	if f.MinScore != nil && grading.Score < *f.MinScore {
+		r.Failures = append(r.Failures, fmt.Sprintf("score %g is below min_score %g", grading.Score, *f.MinScore))
+	}
+	if f.MaxScore != nil && grading.Score > *f.MaxScore {
+		r.Failures = append(r.Failures, fmt.Sprintf("score %g is above max_score %g", grading.Score, *f.MaxScore))
+	}
+	return r
+}
@@ -0,0 +1,50 @@
+package grader
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/PrairieLearn/autograd/metrics"
+)
+
+func TestSelfTest(t *testing.T) {
+	g := newTestGrader(t, nil, []string{"sh", "-c", `echo '{"score": 4, "max_points": 5}' > results.json`})
+	if err := g.SetResults(true, false); err != nil {
+		t.Fatal(err)
+	}
+	four, five := 4.0, 5.0
+	g.AddFixture(Fixture{Name: "passes", JobData: []byte(`{}`), Status: StatusSucceeded, MinScore: &four})
+	g.AddFixture(Fixture{Name: "fails", JobData: []byte(`{}`), MinScore: &five})
+
+	var before bytes.Buffer
+	metrics.Write(&before)
+
+	results := g.SelfTest(context.Background())
+	if len(results) != 2 {
+		t.Fatalf("got %d fixture results, want 2", len(results))
+	}
+	if !results[0].Passed() {
+		t.Errorf("fixture %s failed: %v", results[0].Name, results[0].Failures)
+	}
+	if results[1].Passed() {
+		t.Errorf("fixture %s passed with score %g below min_score 5", results[1].Name, results[1].Result.Grading.Score)
+	}
+
+	var after bytes.Buffer
+	metrics.Write(&after)
+	if before.String() != after.String() {
+		t.Errorf("self-test changed metrics from\n%s\nto\n%s", before.String(), after.String())
+	}
+}
+
+func TestZeroRecorderDoesNotListJobs(t *testing.T) {
+	job := recorder{}.startJob("selftest-example", "")
+	defer job.finish()
+
+	for _, status := range RunningJobs() {
+		if status.GID == "selftest-example" {
+			t.Error("job started by the zero recorder is listed in RunningJobs")
+		}
+	}
+}
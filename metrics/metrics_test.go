@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCounterWrite(t *testing.T) {
+	c := NewCounter("test_counter_total", "A counter.", "queue", "reason")
+	c.Inc("grade", "retried")
+	c.Add(2, "grade", "aborted")
+	c.Inc("grade", "retried")
+	c.Inc(`say "hi"`, "back\\slash\nnewline")
+
+	want := `# HELP test_counter_total A counter.
+# TYPE test_counter_total counter
+test_counter_total{queue="grade",reason="aborted"} 2
+test_counter_total{queue="grade",reason="retried"} 2
+test_counter_total{queue="say \"hi\"",reason="back\\slash\nnewline"} 1
+`
+	var b bytes.Buffer
+	c.write(&b)
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterWithoutLabelsWritesZero(t *testing.T) {
+	c := NewCounter("test_unlabeled_total", "An unlabeled counter.")
+
+	want := `# HELP test_unlabeled_total An unlabeled counter.
+# TYPE test_unlabeled_total counter
+test_unlabeled_total 0
+`
+	var b bytes.Buffer
+	c.write(&b)
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGaugeWrite(t *testing.T) {
+	g := NewGauge("test_info", "An info gauge.", "commit")
+	g.Set(1, "abc")
+	g.Reset()
+	g.Set(1, "def")
+
+	want := `# HELP test_info An info gauge.
+# TYPE test_info gauge
+test_info{commit="def"} 1
+`
+	var b bytes.Buffer
+	g.write(&b)
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := NewHistogram("test_seconds", "A histogram.", []float64{0.5, 1, 2.5}, "stage")
+	for _, v := range []float64{0.25, 1, 1.5, 10} {
+		h.Observe(v, "setup")
+	}
+	h.Observe(0.5, "grade")
+
+	want := `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{stage="grade",le="0.5"} 1
+test_seconds_bucket{stage="grade",le="1"} 1
+test_seconds_bucket{stage="grade",le="2.5"} 1
+test_seconds_bucket{stage="grade",le="+Inf"} 1
+test_seconds_sum{stage="grade"} 0.5
+test_seconds_count{stage="grade"} 1
+test_seconds_bucket{stage="setup",le="0.5"} 1
+test_seconds_bucket{stage="setup",le="1"} 2
+test_seconds_bucket{stage="setup",le="2.5"} 3
+test_seconds_bucket{stage="setup",le="+Inf"} 4
+test_seconds_sum{stage="setup"} 12.75
+test_seconds_count{stage="setup"} 4
+`
+	var b bytes.Buffer
+	h.write(&b)
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWrongLabelCountPanics(t *testing.T) {
+	c := NewCounter("test_panics_total", "A counter.", "reason")
+	defer func() {
+		if recover() == nil {
+			t.Error("Inc with no label values did not panic")
+		}
+	}()
+	c.Inc()
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	got := ExponentialBuckets(0.5, 4, 3)
+	want := []float64{0.5, 2, 8}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -2,6 +2,7 @@ package repo
 
 import (
 	"os"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"gopkg.in/libgit2/git2go.v24"
@@ -9,7 +10,14 @@ import (
 	"github.com/PrairieLearn/autograd/grader"
 )
 
+// repoMu serializes operations on the grader repo, which may be reloaded
+// while revisions are being checked out of it.
+var repoMu sync.Mutex
+
 func Sync(repoURL, commit, autogradRoot, publicKey, privateKey, passphrase string) error {
+	repoMu.Lock()
+	defer repoMu.Unlock()
+
 	path := grader.GetGraderRoot(autogradRoot)
 
 	log.Infof("Syncing grader repo %s", repoURL)
@@ -61,6 +69,112 @@ func Sync(repoURL, commit, autogradRoot, publicKey, privateKey, passphrase strin
 	return nil
 }
 
+// Fetch fetches the grader repo and returns the id of the commit that commit
+// resolves to, without changing the checked out revision.
+func Fetch(repoURL, commit, autogradRoot, publicKey, privateKey, passphrase string) (string, error) {
+	repoMu.Lock()
+	defer repoMu.Unlock()
+
+	path := grader.GetGraderRoot(autogradRoot)
+
+	repo, err := git.OpenRepository(path)
+	if err != nil {
+		return "", err
+	}
+
+	fetchOpts := &git.FetchOptions{
+		RemoteCallbacks: git.RemoteCallbacks{
+			CertificateCheckCallback: makeCertificateCheckCallback(),
+			CredentialsCallback:      makeCredentialsCallback(publicKey, privateKey, passphrase),
+		},
+		DownloadTags: git.DownloadTagsAll,
+	}
+
+	log.Debugf("Fetching remote origin of %s", repoURL)
+	if err := fetchOrigin(repo, fetchOpts); err != nil {
+		return "", err
+	}
+
+	return resolveCommit(repo, commit)
+}
+
+// Head returns the id of the commit checked out in the grader repo.
+func Head(autogradRoot string) (string, error) {
+	repoMu.Lock()
+	defer repoMu.Unlock()
+
+	repo, err := git.OpenRepository(grader.GetGraderRoot(autogradRoot))
+	if err != nil {
+		return "", err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Target().String(), nil
+}
+
+// Resolve returns the id of the commit that commit resolves to in the
+// grader repo, without fetching.
+func Resolve(commit, autogradRoot string) (string, error) {
+	repoMu.Lock()
+	defer repoMu.Unlock()
+
+	repo, err := git.OpenRepository(grader.GetGraderRoot(autogradRoot))
+	if err != nil {
+		return "", err
+	}
+
+	return resolveCommit(repo, commit)
+}
+
+// Checkout writes the files of commit in the grader repo to dir, leaving the
+// grader repo's own working copy untouched.
+func Checkout(commit, autogradRoot, dir string) error {
+	repoMu.Lock()
+	defer repoMu.Unlock()
+
+	repo, err := git.OpenRepository(grader.GetGraderRoot(autogradRoot))
+	if err != nil {
+		return err
+	}
+
+	obj, err := repo.RevparseSingle(commit)
+	if err != nil {
+		return err
+	}
+
+	treeObj, err := obj.Peel(git.ObjectTree)
+	if err != nil {
+		return err
+	}
+	tree, err := treeObj.AsTree()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Checking out commit/ref '%s' to %s", commit, dir)
+	return repo.CheckoutTree(tree, &git.CheckoutOpts{
+		Strategy:        git.CheckoutForce | git.CheckoutDontUpdateIndex | git.CheckoutDontWriteIndex,
+		TargetDirectory: dir,
+	})
+}
+
+// resolveCommit returns the id of the commit that commit resolves to,
+// peeling annotated tags to the commit they point at.
+func resolveCommit(repo *git.Repository, commit string) (string, error) {
+	obj, err := repo.RevparseSingle(commit)
+	if err != nil {
+		return "", err
+	}
+	commitObj, err := obj.Peel(git.ObjectCommit)
+	if err != nil {
+		return "", err
+	}
+	return commitObj.Id().String(), nil
+}
+
 func initializeRepo(repoURL, path string, cloneOpts *git.CloneOptions) (*git.Repository, error) {
 	shouldClone := false
 